@@ -1,6 +1,9 @@
 package config
 
 import (
+	"compress/gzip"
+	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -12,24 +15,124 @@ const (
 	DefaultLogLevel      = "INFO"
 	DebugLogLevel        = "DEBUG"
 	defaultLogServerHost = "sandbox.localdomain"
+
+	TimestampPrecisionMillis  = "ms"
+	TimestampPrecisionSeconds = "s"
+
+	CompressionGzip     = "gzip"
+	CompressionIdentity = "identity"
+
+	RegionUS = "us"
+	RegionEU = "eu"
+
+	InitTypeOnDemand               = "on-demand"
+	InitTypeProvisionedConcurrency = "provisioned-concurrency"
 )
 
 var EmptyNRWrapper = "Undefined"
 
 type Configuration struct {
-	ExtensionEnabled   bool
-	LicenseKey         string
-	LicenseKeySecretId string
-	NRHandler          string
-	TelemetryEndpoint  string
-	LogEndpoint        string
-	RipeMillis         uint32
-	RotMillis          uint32
-	LogLevel           string
-	LogsEnabled        bool
-	SendFunctionLogs   bool
-	LogServerHost      string
-	CollectTraceID     bool
+	ExtensionEnabled     bool
+	LicenseKey           string
+	LicenseKeySecretId   string
+	NRHandler            string
+	TelemetryEndpoint    string
+	LogEndpoint          string
+	RipeMillis           uint32
+	RotMillis            uint32
+	HarvestJitterMillis  uint32
+	FirstSendDelayMillis uint32
+	BatchFlushBytes      uint32
+	MaxInvocations       uint32
+	MaxLogsPerPayload    uint32
+	SendEveryNInvokes    uint32
+	LogDeliveryGapMillis uint32
+	Compression          string
+	CompressionLevel     int
+	MaxPayloadBytes      uint32
+	LogStreamName        string
+	ConnectTimeoutMillis uint32
+	TLSTimeoutMillis     uint32
+	HeaderTimeoutMillis  uint32
+	TeeLogs              string
+	AttributeAllowlist   []string
+	CompressionFallback  bool
+	LogLevel             string
+	LogsEnabled          bool
+	SendFunctionLogs     bool
+	LogServerHost        string
+	CollectTraceID       bool
+	FlattenAttributes    bool
+	SpillDir             string
+	TimestampPrecision   string
+	WebhookURL           string
+	SortLogs             bool
+	RequireLicenseKey    bool
+	DisableHTTP2         bool
+	FunctionVersion      string
+	CollapseDuplicates   bool
+	SanitizeControlChars bool
+	LogEffectiveConfig   bool
+	TelemetryContentType string
+	LogContentType       string
+	LicenseKeyFile       string
+	CaptureEnv           []string
+	MaxAttributes        uint32
+	RetryBudgetMillis    uint32
+	ServiceName          string
+	LogReadTimeoutMillis uint32
+	LogReadHeaderMillis  uint32
+	Region               string
+	ForwardExtensionLogs bool
+	HarvestOnReport      bool
+	MaxAttempts          uint32
+	TelemetryMaxAttempts uint32
+	LogMaxAttempts       uint32
+	RunOnce              bool
+	HeaderAllowanceBytes uint32
+	PrefixLogType        bool
+	DeadLetterDir        string
+	InitType             string
+	EnvironmentEvent     bool
+}
+
+// redacted replaces secret configuration values
+const redacted = "[REDACTED]"
+
+// Redacted returns a description of the configuration, with secrets redacted, which is safe to log
+func (c *Configuration) Redacted() string {
+	safe := *c
+	if safe.LicenseKey != "" {
+		safe.LicenseKey = redacted
+	}
+	// Webhook URLs often embed a token
+	if safe.WebhookURL != "" {
+		safe.WebhookURL = redacted
+	}
+	safe.TelemetryEndpoint = redactURL(safe.TelemetryEndpoint)
+	safe.LogEndpoint = redactURL(safe.LogEndpoint)
+	return fmt.Sprintf("%+v", safe)
+}
+
+// redactURL redacts the userinfo and query string of a URL, either of which may carry credentials. A URL that can't
+// be parsed is redacted entirely.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		u.RawQuery = redacted
+	}
+	u.Fragment = ""
+	if u.User == nil {
+		return u.String()
+	}
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+redacted+"@", 1)
 }
 
 func ConfigurationFromEnvironment() *Configuration {
@@ -41,11 +144,62 @@ func ConfigurationFromEnvironment() *Configuration {
 	logEndpoint, leOverride := os.LookupEnv("NEW_RELIC_LOG_ENDPOINT")
 	ripeMillisStr, ripeMillisOverride := os.LookupEnv("NEW_RELIC_HARVEST_RIPE_MILLIS")
 	rotMillisStr, rotMillisOverride := os.LookupEnv("NEW_RELIC_HARVEST_ROT_MILLIS")
+	harvestJitterStr, harvestJitterOverride := os.LookupEnv("NEW_RELIC_HARVEST_JITTER_MILLIS")
+	firstSendDelayStr, firstSendDelayOverride := os.LookupEnv("NEW_RELIC_FIRST_SEND_DELAY_MS")
+	batchFlushBytesStr, batchFlushBytesOverride := os.LookupEnv("NEW_RELIC_BATCH_FLUSH_BYTES")
+	maxInvocationsStr, maxInvocationsOverride := os.LookupEnv("NEW_RELIC_MAX_INVOCATIONS")
+	maxLogsPerPayloadStr, maxLogsPerPayloadOverride := os.LookupEnv("NEW_RELIC_MAX_LOGS_PER_PAYLOAD")
+	sendEveryNStr, sendEveryNOverride := os.LookupEnv("NEW_RELIC_SEND_EVERY_N_INVOKES")
+	logDeliveryGapStr, logDeliveryGapOverride := os.LookupEnv("NEW_RELIC_LOG_DELIVERY_GAP_MILLIS")
+	compressionStr, compressionOverride := os.LookupEnv("NEW_RELIC_COMPRESSION")
+	compressionLevelStr, compressionLevelOverride := os.LookupEnv("NEW_RELIC_COMPRESSION_LEVEL")
+	maxPayloadBytesStr, maxPayloadBytesOverride := os.LookupEnv("NEW_RELIC_MAX_PAYLOAD_BYTES")
+	logStreamName, logStreamNameOverride := os.LookupEnv("NEW_RELIC_LOG_STREAM_NAME")
+	connectTimeoutStr, connectTimeoutOverride := os.LookupEnv("NEW_RELIC_CONNECT_TIMEOUT_MILLIS")
+	tlsTimeoutStr, tlsTimeoutOverride := os.LookupEnv("NEW_RELIC_TLS_HANDSHAKE_TIMEOUT_MILLIS")
+	headerTimeoutStr, headerTimeoutOverride := os.LookupEnv("NEW_RELIC_RESPONSE_HEADER_TIMEOUT_MILLIS")
+	teeLogsStr, teeLogsOverride := os.LookupEnv("NEW_RELIC_TEE_LOGS")
+	attributeAllowlistStr, attributeAllowlistOverride := os.LookupEnv("NEW_RELIC_ATTRIBUTE_ALLOWLIST")
+	compressionFallbackStr, compressionFallbackOverride := os.LookupEnv("NEW_RELIC_COMPRESSION_FALLBACK")
+	logEffectiveConfigStr, logEffectiveConfigOverride := os.LookupEnv("NEW_RELIC_LOG_EFFECTIVE_CONFIG")
+	telemetryContentType, telemetryContentTypeOverride := os.LookupEnv("NEW_RELIC_TELEMETRY_CONTENT_TYPE")
+	logContentType, logContentTypeOverride := os.LookupEnv("NEW_RELIC_LOG_CONTENT_TYPE")
+	licenseKeyFile, licenseKeyFileOverride := os.LookupEnv("NEW_RELIC_LICENSE_KEY_FILE")
+	captureEnvStr, captureEnvOverride := os.LookupEnv("NEW_RELIC_CAPTURE_ENV")
+	maxAttributesStr, maxAttributesOverride := os.LookupEnv("NEW_RELIC_MAX_ATTRIBUTES")
+	retryBudgetMillisStr, retryBudgetMillisOverride := os.LookupEnv("NEW_RELIC_RETRY_BUDGET_MILLIS")
+	serviceName, serviceNameOverride := os.LookupEnv("NEW_RELIC_SERVICE_NAME")
+	regionStr, regionOverride := os.LookupEnv("NEW_RELIC_REGION")
+	forwardExtensionLogsStr, forwardExtensionLogsOverride := os.LookupEnv("NEW_RELIC_FORWARD_EXTENSION_LOGS")
+	harvestOnReportStr, harvestOnReportOverride := os.LookupEnv("NEW_RELIC_HARVEST_ON_REPORT")
+	maxAttemptsStr, maxAttemptsOverride := os.LookupEnv("NEW_RELIC_MAX_ATTEMPTS")
+	telemetryMaxAttemptsStr, telemetryMaxAttemptsOverride := os.LookupEnv("NEW_RELIC_TELEMETRY_MAX_ATTEMPTS")
+	logMaxAttemptsStr, logMaxAttemptsOverride := os.LookupEnv("NEW_RELIC_LOG_MAX_ATTEMPTS")
+	runOnceStr, runOnceOverride := os.LookupEnv("NEW_RELIC_RUN_ONCE")
+	environmentEventStr, environmentEventOverride := os.LookupEnv("NEW_RELIC_ENVIRONMENT_EVENT")
+	headerAllowanceStr, headerAllowanceOverride := os.LookupEnv("NEW_RELIC_HEADER_ALLOWANCE_BYTES")
+	prefixLogTypeStr, prefixLogTypeOverride := os.LookupEnv("NEW_RELIC_PREFIX_LOG_TYPE")
+	deadLetterDir, deadLetterDirOverride := os.LookupEnv("NEW_RELIC_DEAD_LETTER_DIR")
+	initType, initTypeOverride := os.LookupEnv("AWS_LAMBDA_INITIALIZATION_TYPE")
+	pcBatchFlushBytesStr, pcBatchFlushBytesOverride := os.LookupEnv("NEW_RELIC_PROVISIONED_BATCH_FLUSH_BYTES")
+	pcSendEveryNStr, pcSendEveryNOverride := os.LookupEnv("NEW_RELIC_PROVISIONED_SEND_EVERY_N_INVOKES")
+	logServerReadTimeoutStr, logServerReadTimeoutOverride := os.LookupEnv("NEW_RELIC_LOG_SERVER_READ_TIMEOUT_MILLIS")
+	logServerReadHeaderTimeoutStr, logServerReadHeaderTimeoutOverride := os.LookupEnv("NEW_RELIC_LOG_SERVER_READ_HEADER_TIMEOUT_MILLIS")
 	logLevelStr, logLevelOverride := os.LookupEnv("NEW_RELIC_EXTENSION_LOG_LEVEL")
 	logsEnabledStr, logsEnabledOverride := os.LookupEnv("NEW_RELIC_EXTENSION_LOGS_ENABLED")
 	sendFunctionLogsStr, sendFunctionLogsOverride := os.LookupEnv("NEW_RELIC_EXTENSION_SEND_FUNCTION_LOGS")
 	logServerHostStr, logServerHostOverride := os.LookupEnv("NEW_RELIC_LOG_SERVER_HOST")
 	collectTraceIDStr, collectTraceIDOverride := os.LookupEnv("NEW_RELIC_COLLECT_TRACE_ID")
+	flattenAttributesStr, flattenAttributesOverride := os.LookupEnv("NEW_RELIC_FLATTEN_ATTRIBUTES")
+	spillDir, spillDirOverride := os.LookupEnv("NEW_RELIC_SPILL_DIR")
+	timestampPrecisionStr, timestampPrecisionOverride := os.LookupEnv("NEW_RELIC_TIMESTAMP_PRECISION")
+	webhookURL, webhookURLOverride := os.LookupEnv("NEW_RELIC_WEBHOOK_URL")
+	sortLogsStr, sortLogsOverride := os.LookupEnv("NEW_RELIC_SORT_LOGS")
+	requireLicenseKeyStr, requireLicenseKeyOverride := os.LookupEnv("NEW_RELIC_REQUIRE_LICENSE_KEY")
+	disableHTTP2Str, disableHTTP2Override := os.LookupEnv("NEW_RELIC_DISABLE_HTTP2")
+	functionVersion, functionVersionOverride := os.LookupEnv("AWS_LAMBDA_FUNCTION_VERSION")
+	collapseDuplicatesStr, collapseDuplicatesOverride := os.LookupEnv("NEW_RELIC_COLLAPSE_DUPLICATES")
+	sanitizeControlCharsStr, sanitizeControlCharsOverride := os.LookupEnv("NEW_RELIC_SANITIZE_CONTROL_CHARS")
 
 	extensionEnabled := true
 	if extensionEnabledOverride && strings.ToLower(enabledStr) == "false" {
@@ -101,12 +255,270 @@ func ConfigurationFromEnvironment() *Configuration {
 		ret.RotMillis = DefaultRotMillis
 	}
 
+	if harvestJitterOverride {
+		harvestJitter, err := strconv.ParseUint(harvestJitterStr, 10, 32)
+		if err == nil {
+			ret.HarvestJitterMillis = uint32(harvestJitter)
+		}
+	}
+
+	if firstSendDelayOverride {
+		firstSendDelay, err := strconv.ParseUint(firstSendDelayStr, 10, 32)
+		if err == nil {
+			ret.FirstSendDelayMillis = uint32(firstSendDelay)
+		}
+	}
+
+	if batchFlushBytesOverride {
+		batchFlushBytes, err := strconv.ParseUint(batchFlushBytesStr, 10, 32)
+		if err == nil {
+			ret.BatchFlushBytes = uint32(batchFlushBytes)
+		}
+	}
+
+	if maxInvocationsOverride {
+		maxInvocations, err := strconv.ParseUint(maxInvocationsStr, 10, 32)
+		if err == nil {
+			ret.MaxInvocations = uint32(maxInvocations)
+		}
+	}
+
+	if maxLogsPerPayloadOverride {
+		maxLogsPerPayload, err := strconv.ParseUint(maxLogsPerPayloadStr, 10, 32)
+		if err == nil {
+			ret.MaxLogsPerPayload = uint32(maxLogsPerPayload)
+		}
+	}
+
+	if sendEveryNOverride {
+		sendEveryN, err := strconv.ParseUint(sendEveryNStr, 10, 32)
+		if err == nil {
+			ret.SendEveryNInvokes = uint32(sendEveryN)
+		}
+	}
+
+	if logDeliveryGapOverride {
+		logDeliveryGap, err := strconv.ParseUint(logDeliveryGapStr, 10, 32)
+		if err == nil {
+			ret.LogDeliveryGapMillis = uint32(logDeliveryGap)
+		}
+	}
+
+	if compressionOverride && compressionStr == CompressionIdentity {
+		ret.Compression = CompressionIdentity
+	} else {
+		ret.Compression = CompressionGzip
+	}
+
+	ret.CompressionLevel = gzip.DefaultCompression
+	if compressionLevelOverride {
+		compressionLevel, err := strconv.Atoi(compressionLevelStr)
+		if err == nil && compressionLevel >= gzip.HuffmanOnly && compressionLevel <= gzip.BestCompression {
+			ret.CompressionLevel = compressionLevel
+		}
+	}
+
+	if maxPayloadBytesOverride {
+		maxPayloadBytes, err := strconv.ParseUint(maxPayloadBytesStr, 10, 32)
+		if err == nil {
+			ret.MaxPayloadBytes = uint32(maxPayloadBytes)
+		}
+	}
+
+	if logStreamNameOverride {
+		ret.LogStreamName = logStreamName
+	}
+
+	if connectTimeoutOverride {
+		connectTimeout, err := strconv.ParseUint(connectTimeoutStr, 10, 32)
+		if err == nil {
+			ret.ConnectTimeoutMillis = uint32(connectTimeout)
+		}
+	}
+
+	if tlsTimeoutOverride {
+		tlsTimeout, err := strconv.ParseUint(tlsTimeoutStr, 10, 32)
+		if err == nil {
+			ret.TLSTimeoutMillis = uint32(tlsTimeout)
+		}
+	}
+
+	if headerTimeoutOverride {
+		headerTimeout, err := strconv.ParseUint(headerTimeoutStr, 10, 32)
+		if err == nil {
+			ret.HeaderTimeoutMillis = uint32(headerTimeout)
+		}
+	}
+
+	// Tee logs at the given log level; true means the default level
+	if teeLogsOverride {
+		switch strings.ToUpper(teeLogsStr) {
+		case DebugLogLevel:
+			ret.TeeLogs = DebugLogLevel
+		case DefaultLogLevel, "TRUE":
+			ret.TeeLogs = DefaultLogLevel
+		}
+	}
+
+	if attributeAllowlistOverride {
+		for _, attribute := range strings.Split(attributeAllowlistStr, ",") {
+			attribute = strings.TrimSpace(attribute)
+			if attribute != "" {
+				ret.AttributeAllowlist = append(ret.AttributeAllowlist, attribute)
+			}
+		}
+	}
+
+	if compressionFallbackOverride && compressionFallbackStr == "true" {
+		ret.CompressionFallback = true
+	}
+
+	if logEffectiveConfigOverride && logEffectiveConfigStr == "true" {
+		ret.LogEffectiveConfig = true
+	}
+
+	if telemetryContentTypeOverride {
+		ret.TelemetryContentType = telemetryContentType
+	}
+
+	if logContentTypeOverride {
+		ret.LogContentType = logContentType
+	}
+
+	if licenseKeyFileOverride {
+		ret.LicenseKeyFile = licenseKeyFile
+	}
+
+	if captureEnvOverride {
+		for _, name := range strings.Split(captureEnvStr, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				ret.CaptureEnv = append(ret.CaptureEnv, name)
+			}
+		}
+	}
+
+	if maxAttributesOverride {
+		maxAttributes, err := strconv.ParseUint(maxAttributesStr, 10, 32)
+		if err == nil {
+			ret.MaxAttributes = uint32(maxAttributes)
+		}
+	}
+
+	if retryBudgetMillisOverride {
+		retryBudgetMillis, err := strconv.ParseUint(retryBudgetMillisStr, 10, 32)
+		if err == nil {
+			ret.RetryBudgetMillis = uint32(retryBudgetMillis)
+		}
+	}
+
+	if serviceNameOverride {
+		ret.ServiceName = serviceName
+	}
+
+	if regionOverride {
+		region := strings.ToLower(strings.TrimSpace(regionStr))
+		if region == RegionUS || region == RegionEU {
+			ret.Region = region
+		}
+	}
+
+	if forwardExtensionLogsOverride && forwardExtensionLogsStr == "true" {
+		ret.ForwardExtensionLogs = true
+	}
+
+	if harvestOnReportOverride && harvestOnReportStr == "true" {
+		ret.HarvestOnReport = true
+	}
+
+	if maxAttemptsOverride {
+		maxAttempts, err := strconv.ParseUint(maxAttemptsStr, 10, 32)
+		if err == nil {
+			ret.MaxAttempts = uint32(maxAttempts)
+		}
+	}
+
+	if telemetryMaxAttemptsOverride {
+		telemetryMaxAttempts, err := strconv.ParseUint(telemetryMaxAttemptsStr, 10, 32)
+		if err == nil {
+			ret.TelemetryMaxAttempts = uint32(telemetryMaxAttempts)
+		}
+	}
+
+	if logMaxAttemptsOverride {
+		logMaxAttempts, err := strconv.ParseUint(logMaxAttemptsStr, 10, 32)
+		if err == nil {
+			ret.LogMaxAttempts = uint32(logMaxAttempts)
+		}
+	}
+
+	if runOnceOverride && runOnceStr == "true" {
+		ret.RunOnce = true
+	}
+
+	if environmentEventOverride && environmentEventStr == "true" {
+		ret.EnvironmentEvent = true
+	}
+
+	if headerAllowanceOverride {
+		headerAllowance, err := strconv.ParseUint(headerAllowanceStr, 10, 32)
+		if err == nil {
+			ret.HeaderAllowanceBytes = uint32(headerAllowance)
+		}
+	}
+
+	if prefixLogTypeOverride && prefixLogTypeStr == "true" {
+		ret.PrefixLogType = true
+	}
+
+	if deadLetterDirOverride {
+		ret.DeadLetterDir = deadLetterDir
+	}
+
+	if initTypeOverride {
+		ret.InitType = initType
+	}
+
+	// Provisioned-concurrency sandboxes stay warm for longer than on-demand ones, so they can batch under their own
+	// thresholds, which replace the on-demand ones when set.
+	if ret.InitType == InitTypeProvisionedConcurrency {
+		if pcBatchFlushBytesOverride {
+			pcBatchFlushBytes, err := strconv.ParseUint(pcBatchFlushBytesStr, 10, 32)
+			if err == nil {
+				ret.BatchFlushBytes = uint32(pcBatchFlushBytes)
+			}
+		}
+
+		if pcSendEveryNOverride {
+			pcSendEveryN, err := strconv.ParseUint(pcSendEveryNStr, 10, 32)
+			if err == nil {
+				ret.SendEveryNInvokes = uint32(pcSendEveryN)
+			}
+		}
+	}
+
+	if logServerReadTimeoutOverride {
+		logServerReadTimeout, err := strconv.ParseUint(logServerReadTimeoutStr, 10, 32)
+		if err == nil {
+			ret.LogReadTimeoutMillis = uint32(logServerReadTimeout)
+		}
+	}
+
+	if logServerReadHeaderTimeoutOverride {
+		logServerReadHeaderTimeout, err := strconv.ParseUint(logServerReadHeaderTimeoutStr, 10, 32)
+		if err == nil {
+			ret.LogReadHeaderMillis = uint32(logServerReadHeaderTimeout)
+		}
+	}
+
 	if logLevelOverride && logLevelStr == DebugLogLevel {
 		ret.LogLevel = DebugLogLevel
 	} else {
 		ret.LogLevel = DefaultLogLevel
 	}
 
+	// The log server's listen address. This doubles as the listener address setting (there is no separate
+	// NEW_RELIC_LISTENER_ADDR): a hostname, or an IPv4 or IPv6 address, without a port.
 	if logServerHostOverride {
 		ret.LogServerHost = logServerHostStr
 	} else {
@@ -121,5 +533,47 @@ func ConfigurationFromEnvironment() *Configuration {
 		ret.CollectTraceID = true
 	}
 
+	if flattenAttributesOverride && flattenAttributesStr == "true" {
+		ret.FlattenAttributes = true
+	}
+
+	if spillDirOverride {
+		ret.SpillDir = spillDir
+	}
+
+	if timestampPrecisionOverride && timestampPrecisionStr == TimestampPrecisionSeconds {
+		ret.TimestampPrecision = TimestampPrecisionSeconds
+	} else {
+		ret.TimestampPrecision = TimestampPrecisionMillis
+	}
+
+	if webhookURLOverride {
+		ret.WebhookURL = webhookURL
+	}
+
+	if sortLogsOverride && sortLogsStr == "true" {
+		ret.SortLogs = true
+	}
+
+	if requireLicenseKeyOverride && requireLicenseKeyStr == "true" {
+		ret.RequireLicenseKey = true
+	}
+
+	if disableHTTP2Override && disableHTTP2Str == "true" {
+		ret.DisableHTTP2 = true
+	}
+
+	if functionVersionOverride {
+		ret.FunctionVersion = functionVersion
+	}
+
+	if collapseDuplicatesOverride && collapseDuplicatesStr == "true" {
+		ret.CollapseDuplicates = true
+	}
+
+	if sanitizeControlCharsOverride && sanitizeControlCharsStr == "true" {
+		ret.SanitizeControlChars = true
+	}
+
 	return ret
 }
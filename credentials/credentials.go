@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/newrelic/newrelic-lambda-extension/util"
 
@@ -28,6 +31,11 @@ var (
 
 const defaultSecretId = "NEW_RELIC_LICENSE_KEY"
 
+const licenseKeyLength = 40
+
+// alphanumericRegExp matches runs of alphanumeric characters, one of which may be a license key
+var alphanumericRegExp = regexp.MustCompile(`[A-Za-z0-9]+`)
+
 func init() {
 	secrets = secretsmanager.New(sess)
 }
@@ -46,7 +54,12 @@ func decodeLicenseKey(rawJson *string) (string, error) {
 
 	err := json.Unmarshal([]byte(*rawJson), &secrets)
 	if err != nil {
-		return "", err
+		licenseKey, ok := recoverLicenseKey(*rawJson)
+		if !ok {
+			return "", err
+		}
+		util.Logf("Warning: license key secret is not valid JSON (%v); using the license key found in it\n", err)
+		return licenseKey, nil
 	}
 	if secrets.LicenseKey == "" {
 		return "", fmt.Errorf("malformed license key secret; missing \"LicenseKey\" attribute")
@@ -55,6 +68,21 @@ func decodeLicenseKey(rawJson *string) (string, error) {
 	return secrets.LicenseKey, nil
 }
 
+// recoverLicenseKey finds a license key in a malformed secret. It only succeeds if there is exactly one candidate.
+func recoverLicenseKey(raw string) (string, bool) {
+	var candidates []string
+	for _, run := range alphanumericRegExp.FindAllString(raw, -1) {
+		if len(run) == licenseKeyLength {
+			candidates = append(candidates, run)
+		}
+	}
+	if len(candidates) != 1 {
+		return "", false
+	}
+
+	return candidates[0], true
+}
+
 // IsSecretConfigured returns true if the Secrets Maanger secret is configured, false
 // otherwise
 func IsSecretConfigured(ctx context.Context, conf *config.Configuration) bool {
@@ -69,14 +97,34 @@ func IsSecretConfigured(ctx context.Context, conf *config.Configuration) bool {
 	return true
 }
 
-// GetNewRelicLicenseKey fetches the license key from AWS Secrets Manager, falling back
-// to the NEW_RELIC_LICENSE_KEY environment variable if set.
+// readLicenseKeyFile reads a license key from a file, ignoring surrounding whitespace
+func readLicenseKeyFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read license key file: %v", err)
+	}
+
+	licenseKey := strings.TrimSpace(string(contents))
+	if licenseKey == "" {
+		return "", fmt.Errorf("license key file %s is empty", path)
+	}
+
+	return licenseKey, nil
+}
+
+// GetNewRelicLicenseKey fetches the license key from the NEW_RELIC_LICENSE_KEY environment variable, then the
+// NEW_RELIC_LICENSE_KEY_FILE file, and otherwise from AWS Secrets Manager.
 func GetNewRelicLicenseKey(ctx context.Context, conf *config.Configuration) (string, error) {
 	if conf.LicenseKey != "" {
 		util.Logln("Using license key from environment variable")
 		return conf.LicenseKey, nil
 	}
 
+	if conf.LicenseKeyFile != "" {
+		util.Logln("Using license key from file " + conf.LicenseKeyFile)
+		return readLicenseKeyFile(conf.LicenseKeyFile)
+	}
+
 	secretId := getLicenseKeySecretId(conf)
 	secretValueInput := secretsmanager.GetSecretValueInput{SecretId: &secretId}
 
@@ -3,7 +3,10 @@ package credentials
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/newrelic/newrelic-lambda-extension/config"
@@ -83,6 +86,35 @@ func TestGetNewRelicLicenseKeyConfigValue(t *testing.T) {
 	assert.Equal(t, licenseKey, resultKey)
 }
 
+func TestGetNewRelicLicenseKeyFile(t *testing.T) {
+	OverrideSecretsManager(mockSecretManager{})
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "license-key")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "license-key")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("  file_value\n"), 0600))
+
+	lk, err := GetNewRelicLicenseKey(ctx, &config.Configuration{LicenseKeyFile: path})
+	assert.NoError(t, err)
+	assert.Equal(t, "file_value", lk)
+
+	lk, err = GetNewRelicLicenseKey(ctx, &config.Configuration{LicenseKey: "env_value", LicenseKeyFile: path})
+	assert.NoError(t, err)
+	assert.Equal(t, "env_value", lk)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("\n"), 0600))
+	lk, err = GetNewRelicLicenseKey(ctx, &config.Configuration{LicenseKeyFile: path})
+	assert.Error(t, err)
+	assert.Empty(t, lk)
+
+	lk, err = GetNewRelicLicenseKey(ctx, &config.Configuration{LicenseKeyFile: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+	assert.Empty(t, lk)
+}
+
 func TestDecodeLicenseKey(t *testing.T) {
 	invalidJson := "invalid json"
 	decoded, err := decodeLicenseKey(&invalidJson)
@@ -96,3 +128,28 @@ func TestDecodeLicenseKeyValidButWrong(t *testing.T) {
 	assert.Empty(t, decoded)
 	assert.Error(t, err)
 }
+
+func TestDecodeLicenseKeyMalformed(t *testing.T) {
+	licenseKey := "0123456789abcdef0123456789abcdef0123NRAL"
+
+	for _, raw := range []string{
+		`{"LicenseKey": "` + licenseKey + `"`,
+		`{LicenseKey: ` + licenseKey + `}`,
+		licenseKey + "\n",
+	} {
+		decoded, err := decodeLicenseKey(&raw)
+		assert.NoError(t, err, raw)
+		assert.Equal(t, licenseKey, decoded, raw)
+	}
+
+	for _, raw := range []string{
+		`{"LicenseKey": "too-short"`,
+		`{"LicenseKey": "` + licenseKey + `0"`,
+		`{"LicenseKey": "` + licenseKey + `", "OtherKey": "` + strings.Repeat("a", 40) + `"`,
+		`{"LicenseKey": "` + licenseKey + `,` + strings.Repeat("a", 40) + `"`,
+	} {
+		decoded, err := decodeLicenseKey(&raw)
+		assert.Error(t, err, raw)
+		assert.Empty(t, decoded, raw)
+	}
+}
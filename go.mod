@@ -7,7 +7,7 @@ require (
 	github.com/aws/aws-sdk-go v1.34.21
 	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/google/go-github/v44 v44.1.0
-	github.com/google/uuid v1.1.2
+	github.com/google/uuid v1.3.0
 	github.com/newrelic/go-agent/v3 v3.9.0
 	github.com/newrelic/go-agent/v3/integrations/nrlambda v1.2.0
 	github.com/stretchr/testify v1.6.1
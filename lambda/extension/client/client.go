@@ -13,11 +13,35 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sync/atomic"
 
 	"github.com/newrelic/newrelic-lambda-extension/lambda/extension/api"
 	"github.com/newrelic/newrelic-lambda-extension/util"
 )
 
+// Lambda identifies an extension by the file name it was launched from, and expects that name in the
+// Lambda-Extension-Name header
+var validExtensionName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// throttledRequests counts Extensions API requests rejected with 429 Too Many Requests
+var throttledRequests uint64
+
+// ThrottledRequests returns the number of Extensions API requests that have been throttled
+func ThrottledRequests() uint64 {
+	return atomic.LoadUint64(&throttledRequests)
+}
+
+// countThrottled records and logs a throttled response to an Extensions API request
+func countThrottled(res *http.Response, request string) {
+	if res.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	count := atomic.AddUint64(&throttledRequests, 1)
+	util.Logf("Extensions API throttled the %s request (%d throttled requests so far)\n", request, count)
+}
+
 // InvocationClient is used to poll for invocation events. It is produced as a result of successful
 // registration. The zero value is not usable.
 type InvocationClient struct {
@@ -64,8 +88,25 @@ func (rc *RegistrationClient) RegisterDefault(ctx context.Context) (*InvocationC
 	return rc.Register(ctx, defaultRequest)
 }
 
+// ValidateExtensionName returns an error if name can't be used to register an extension
+func ValidateExtensionName(name string) error {
+	if name == "" {
+		return fmt.Errorf("extension name is empty")
+	}
+
+	if !validExtensionName.MatchString(name) {
+		return fmt.Errorf("extension name %q is invalid; it must be the extension's file name, using only letters, digits, '.', '_' and '-'", name)
+	}
+
+	return nil
+}
+
 // Register registers, with custom registration parameters.
 func (rc *RegistrationClient) Register(ctx context.Context, registrationRequest api.RegistrationRequest) (*InvocationClient, *api.RegistrationResponse, error) {
+	if err := ValidateExtensionName(rc.extensionName); err != nil {
+		return nil, nil, fmt.Errorf("error occurred while making registration request: %s", err)
+	}
+
 	registrationRequestJson, err := json.Marshal(registrationRequest)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error occurred while marshaling registration request %s", err)
@@ -84,6 +125,7 @@ func (rc *RegistrationClient) Register(ctx context.Context, registrationRequest
 	}
 
 	defer util.Close(res.Body)
+	countThrottled(res, "register")
 
 	if res.StatusCode == http.StatusInternalServerError {
 		util.Panic("error occurred while making registration request: ", res.Status)
@@ -157,6 +199,7 @@ func (ic *InvocationClient) LogRegister(ctx context.Context, subscriptionRequest
 	}
 
 	defer util.Close(res.Body)
+	countThrottled(res, "log subscription")
 
 	if res.StatusCode == http.StatusInternalServerError {
 		util.Panic("error occurred while making log subscription request: ", res.Status)
@@ -191,11 +234,9 @@ func (ic *InvocationClient) NextEvent(ctx context.Context) (*api.InvocationEvent
 	}
 
 	defer util.Close(res.Body)
+	countThrottled(res, "next event")
 
-	if res.StatusCode == http.StatusInternalServerError {
-		util.Panic("error occurred when calling extension/event/next: ", res.Status)
-	}
-
+	// Errors, including 500s, are returned rather than panicking, so that the caller can retry
 	if res.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("error occurred when calling extension/event/next: %s", res.Status)
 	}
@@ -29,6 +29,60 @@ func TestNew(t *testing.T) {
 	assert.Equal(t, exeName, client.extensionName)
 }
 
+func TestValidateExtensionName(t *testing.T) {
+	for _, name := range []string{"newrelic-lambda-extension", "extension_1.2", exeName} {
+		assert.NoError(t, ValidateExtensionName(name), name)
+	}
+
+	for _, name := range []string{"", "extensions/newrelic", "new relic", "ext\n"} {
+		assert.Error(t, ValidateExtensionName(name), name)
+	}
+}
+
+func TestRegistrationClient_RegisterInvalidName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("registration request should not have been made")
+	}))
+	defer srv.Close()
+
+	url := srv.URL[7:]
+	client := RegistrationClient{extensionName: "", version: api.Version, baseUrl: url, httpClient: http.Client{}}
+
+	invocationClient, res, err := client.RegisterDefault(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "extension name is empty")
+	assert.Nil(t, invocationClient)
+	assert.Nil(t, res)
+}
+
+func TestThrottledRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	url := srv.URL[7:]
+	before := ThrottledRequests()
+
+	rc := RegistrationClient{extensionName: exeName, version: api.Version, baseUrl: url, httpClient: http.Client{}}
+	ic, res, err := rc.RegisterDefault(context.Background())
+	assert.Error(t, err)
+	assert.Nil(t, ic)
+	assert.Nil(t, res)
+	assert.Equal(t, before+1, ThrottledRequests())
+
+	ic = &InvocationClient{version: api.Version, baseUrl: url, httpClient: http.Client{}, extensionId: "test-ext-id"}
+	event, err := ic.NextEvent(context.Background())
+	assert.Error(t, err)
+	assert.Nil(t, event)
+	assert.Equal(t, before+2, ThrottledRequests())
+
+	assert.Error(t, ic.LogRegister(context.Background(), api.DefaultLogSubscription([]api.LogEventType{api.Platform}, 12345)))
+	assert.Equal(t, before+3, ThrottledRequests())
+}
+
 func TestRegistrationClient_GetRegisterURL(t *testing.T) {
 	_ = os.Setenv(api.LambdaHostPortEnvVar, "127.0.0.1:8123")
 	defer os.Unsetenv(api.LambdaHostPortEnvVar)
@@ -423,7 +477,7 @@ func TestInvocationClient_NextEventError(t *testing.T) {
 	assert.Nil(t, event)
 }
 
-func TestInvocationClient_NextEventPanic(t *testing.T) {
+func TestInvocationClient_NextEventServerError(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer util.Close(r.Body)
 
@@ -442,7 +496,13 @@ func TestInvocationClient_NextEventPanic(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	assert.Panics(t, func() {
-		client.NextEvent(ctx)
+	var event *api.InvocationEvent
+	var err error
+	assert.NotPanics(t, func() {
+		event, err = client.NextEvent(ctx)
 	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "500")
+	assert.Nil(t, event)
 }
@@ -3,7 +3,6 @@ package logserver
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"regexp"
@@ -18,12 +17,19 @@ import (
 
 const (
 	platformLogBufferSize = 100
+
+	// Function logs are handed off in chunks of at most this many lines, or about this many bytes, while a batch is
+	// still being read
+	functionLogChunkLines = 1000
+	functionLogChunkBytes = 1024 * 1024
 )
 
 type LogLine struct {
 	Time      time.Time
 	RequestID string
 	Content   []byte
+	// Extension is set for lines logged by an extension, rather than by the function
+	Extension bool
 }
 
 type LogServer struct {
@@ -33,6 +39,10 @@ type LogServer struct {
 	functionLogChan   chan []LogLine
 	lastRequestId     string
 	lastRequestIdLock *sync.Mutex
+	lastDelivery      time.Time
+	lastDeliveryLock  *sync.Mutex
+	malformedMetrics  map[string]int
+	malformedLock     *sync.Mutex
 }
 
 func (ls *LogServer) Port() uint16 {
@@ -41,6 +51,40 @@ func (ls *LogServer) Port() uint16 {
 	return uint16(port)
 }
 
+// LastDelivery is when the Logs API last delivered logs, or when the server started if it hasn't yet
+func (ls *LogServer) LastDelivery() time.Time {
+	ls.lastDeliveryLock.Lock()
+	defer ls.lastDeliveryLock.Unlock()
+	return ls.lastDelivery
+}
+
+// MalformedMetrics returns how many report metrics have been left out because they weren't numbers, by metric name
+func (ls *LogServer) MalformedMetrics() map[string]int {
+	ls.malformedLock.Lock()
+	defer ls.malformedLock.Unlock()
+
+	ret := make(map[string]int, len(ls.malformedMetrics))
+	for name, count := range ls.malformedMetrics {
+		ret[name] = count
+	}
+	return ret
+}
+
+// countMalformed records report metrics that were left out of a report line
+func (ls *LogServer) countMalformed(requestId string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	util.Logf("Left malformed metrics %v out of the report for request %s\n", names, requestId)
+
+	ls.malformedLock.Lock()
+	defer ls.malformedLock.Unlock()
+	for _, name := range names {
+		ls.malformedMetrics[name]++
+	}
+}
+
 func (ls *LogServer) Close() error {
 	// Pause briefly to allow final platform logs to arrive
 	time.Sleep(200 * time.Millisecond)
@@ -73,51 +117,72 @@ func (ls *LogServer) AwaitFunctionLogs() ([]LogLine, bool) {
 	return ll, more
 }
 
-func formatReport(metrics map[string]interface{}) string {
+// formatReport formats report metrics the way the platform's REPORT line does. Metrics that aren't numbers are left
+// out, and their names returned.
+func formatReport(metrics map[string]interface{}) (string, []string) {
 	ret := ""
+	var malformed []string
 
-	if val, ok := metrics["durationMs"]; ok {
-		ret += fmt.Sprintf("\tDuration: %.2f ms", val)
-	}
-
-	if val, ok := metrics["billedDurationMs"]; ok {
-		ret += fmt.Sprintf("\tBilled Duration: %.0f ms", val)
-	}
+	format := func(name string, format string) {
+		val, ok := metrics[name]
+		if !ok {
+			return
+		}
 
-	if val, ok := metrics["memorySizeMB"]; ok {
-		ret += fmt.Sprintf("\tMemory Size: %.0f MB", val)
-	}
+		number, ok := val.(float64)
+		if !ok {
+			malformed = append(malformed, name)
+			return
+		}
 
-	if val, ok := metrics["maxMemoryUsedMB"]; ok {
-		ret += fmt.Sprintf("\tMax Memory Used: %.0f MB", val)
+		ret += fmt.Sprintf(format, number)
 	}
 
-	if val, ok := metrics["initDurationMs"]; ok {
-		ret += fmt.Sprintf("\tInit Duration: %.2f ms", val)
-	}
+	format("durationMs", "\tDuration: %.2f ms")
+	format("billedDurationMs", "\tBilled Duration: %.0f ms")
+	format("memorySizeMB", "\tMemory Size: %.0f MB")
+	format("maxMemoryUsedMB", "\tMax Memory Used: %.0f MB")
+	format("initDurationMs", "\tInit Duration: %.2f ms")
 
-	return ret
+	return ret, malformed
 }
 
 var reportStringRegExp, _ = regexp.Compile("RequestId: ([a-fA-F0-9-]+)(.*)")
 
+var hostnameRegExp, _ = regexp.Compile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
 func (ls *LogServer) handler(res http.ResponseWriter, req *http.Request) {
 	defer util.Close(req.Body)
 
-	bodyBytes, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		util.Logf("Error processing log request: %v", err)
-	}
+	ls.lastDeliveryLock.Lock()
+	ls.lastDelivery = time.Now()
+	ls.lastDeliveryLock.Unlock()
 
-	var logEvents []api.LogEvent
-	err = json.Unmarshal(bodyBytes, &logEvents)
+	// Decode the array one event at a time, and hand off function logs in chunks, so that a large batch is never held
+	// in memory all at once
+	decoder := json.NewDecoder(req.Body)
+	token, err := decoder.Token()
 	if err != nil {
 		util.Logf("Error parsing log payload: %v", err)
+		_, _ = res.Write(nil)
+		return
+	}
+	if token != json.Delim('[') {
+		util.Logf("Error parsing log payload: expected an array, got %v", token)
+		_, _ = res.Write(nil)
+		return
 	}
 
 	var functionLogs []LogLine
+	functionLogBytes := 0
+
+	for decoder.More() {
+		var event api.LogEvent
+		if err := decoder.Decode(&event); err != nil {
+			util.Logf("Error parsing log payload: %v", err)
+			break
+		}
 
-	for _, event := range logEvents {
 		switch event.Type {
 		case "platform.start":
 			ls.lastRequestIdLock.Lock()
@@ -138,9 +203,14 @@ func (ls *LogServer) handler(res http.ResponseWriter, req *http.Request) {
 			switch event.Record.(type) {
 			case map[string]interface{}:
 				record := event.Record.(map[string]interface{})
-				metrics := record["metrics"].(map[string]interface{})
-				metricString = formatReport(metrics)
-				requestId = record["requestId"].(string)
+				requestId, _ = record["requestId"].(string)
+				if metrics, ok := record["metrics"].(map[string]interface{}); ok {
+					var malformed []string
+					metricString, malformed = formatReport(metrics)
+					ls.countMalformed(requestId, malformed)
+				} else if _, ok := record["metrics"]; ok {
+					ls.countMalformed(requestId, []string{"metrics"})
+				}
 			case string:
 				recordString := event.Record.(string)
 				results := reportStringRegExp.FindStringSubmatch(recordString)
@@ -167,15 +237,23 @@ func (ls *LogServer) handler(res http.ResponseWriter, req *http.Request) {
 			ls.platformLogChan <- reportLine
 		case "platform.logsDropped":
 			util.Logf("Platform dropped logs: %v", event.Record)
-		case "function":
+		case "function", "extension":
 			record := event.Record.(string)
 			ls.lastRequestIdLock.Lock()
 			functionLogs = append(functionLogs, LogLine{
 				Time:      event.Time,
 				RequestID: ls.lastRequestId,
 				Content:   []byte(record),
+				Extension: event.Type == "extension",
 			})
 			ls.lastRequestIdLock.Unlock()
+
+			functionLogBytes += len(record)
+			if len(functionLogs) >= functionLogChunkLines || functionLogBytes >= functionLogChunkBytes {
+				ls.functionLogChan <- functionLogs
+				functionLogs = nil
+				functionLogBytes = 0
+			}
 		default:
 			//util.Debugln("Ignored log event of type ", event.Type, string(bodyBytes))
 		}
@@ -189,23 +267,44 @@ func (ls *LogServer) handler(res http.ResponseWriter, req *http.Request) {
 }
 
 func Start(conf *config.Configuration) (*LogServer, error) {
-	return startInternal(conf.LogServerHost)
+	err := validateHost(conf.LogServerHost)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		ReadTimeout:       time.Duration(conf.LogReadTimeoutMillis) * time.Millisecond,
+		ReadHeaderTimeout: time.Duration(conf.LogReadHeaderMillis) * time.Millisecond,
+	}
+
+	return startInternal(conf.LogServerHost, server)
 }
 
-func startInternal(host string) (*LogServer, error) {
-	listener, err := net.Listen("tcp", host+":")
+// validateHost checks that host is a bare hostname or IP address, with no port or scheme
+func validateHost(host string) error {
+	if net.ParseIP(host) != nil || hostnameRegExp.MatchString(host) {
+		return nil
+	}
+
+	return fmt.Errorf("invalid log server host %q (NEW_RELIC_LOG_SERVER_HOST); expected a hostname or IP address, without a port", host)
+}
+
+func startInternal(host string, server *http.Server) (*LogServer, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
 	if err != nil {
 		return nil, err
 	}
 
-	server := &http.Server{}
-
 	logServer := &LogServer{
 		listenString:      listener.Addr().String(),
 		server:            server,
 		platformLogChan:   make(chan LogLine, platformLogBufferSize),
 		functionLogChan:   make(chan []LogLine),
 		lastRequestIdLock: &sync.Mutex{},
+		lastDelivery:      time.Now(),
+		lastDeliveryLock:  &sync.Mutex{},
+		malformedMetrics:  make(map[string]int),
+		malformedLock:     &sync.Mutex{},
 	}
 
 	mux := http.NewServeMux()
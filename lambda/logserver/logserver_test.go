@@ -7,6 +7,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"testing"
 	"time"
@@ -17,8 +19,9 @@ import (
 )
 
 func TestLogServer(t *testing.T) {
-	logs, err := startInternal("localhost")
+	logs, err := startInternal("localhost", &http.Server{})
 	assert.NoError(t, err)
+	started := logs.LastDelivery()
 
 	testEvents := []api.LogEvent{
 		{
@@ -53,14 +56,99 @@ func TestLogServer(t *testing.T) {
 
 	logLines := logs.PollPlatformChannel()
 
+	assert.True(t, logs.LastDelivery().After(started))
 	assert.Equal(t, 1, len(logLines))
 	assert.Equal(t, "REPORT RequestId: testRequestId\tDuration: 25.30 ms\tBilled Duration: 100 ms\tMemory Size: 128 MB\tMax Memory Used: 74 MB\tInit Duration: 202.00 ms", string(logLines[0].Content))
 
 	assert.Nil(t, logs.Close())
 }
 
+func TestLogServerMalformedMetrics(t *testing.T) {
+	logs, err := startInternal("localhost", &http.Server{})
+	assert.NoError(t, err)
+
+	testEvents := []api.LogEvent{
+		{
+			Time: time.Now(),
+			Type: "platform.report",
+			Record: map[string]interface{}{
+				"metrics": map[string]interface{}{
+					"durationMs":       25.3,
+					"billedDurationMs": "100",
+					"memorySizeMB":     128.0,
+					"maxMemoryUsedMB":  nil,
+				},
+				"requestId": "testRequestId",
+			},
+		},
+		{
+			Time: time.Now(),
+			Type: "platform.report",
+			Record: map[string]interface{}{
+				"metrics":   "garbage",
+				"requestId": 12345,
+			},
+		},
+	}
+
+	testEventBytes, err := json.Marshal(testEvents)
+	assert.NoError(t, err)
+
+	realEndpoint := fmt.Sprintf("http://localhost:%d", logs.Port())
+	res, err := http.Post(realEndpoint, "application/json", bytes.NewBuffer(testEventBytes))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	logLines := logs.PollPlatformChannel()
+
+	assert.Equal(t, 2, len(logLines))
+	assert.Equal(t, "REPORT RequestId: testRequestId\tDuration: 25.30 ms\tMemory Size: 128 MB", string(logLines[0].Content))
+	assert.Equal(t, "REPORT RequestId: ", string(logLines[1].Content))
+	assert.Equal(t, map[string]int{"billedDurationMs": 1, "maxMemoryUsedMB": 1, "metrics": 1}, logs.MalformedMetrics())
+
+	assert.Nil(t, logs.Close())
+}
+
+func TestExtensionLogs(t *testing.T) {
+	logs, err := startInternal("localhost", &http.Server{})
+	assert.NoError(t, err)
+
+	testEvents := []api.LogEvent{
+		{
+			Time:   time.Now().Add(-50 * time.Millisecond),
+			Type:   "function",
+			Record: "function log line",
+		},
+		{
+			Time:   time.Now(),
+			Type:   "extension",
+			Record: "extension log line",
+		},
+	}
+
+	testEventBytes, err := json.Marshal(testEvents)
+	assert.NoError(t, err)
+
+	realEndpoint := fmt.Sprintf("http://localhost:%d", logs.Port())
+	go func() {
+		res, err := http.Post(realEndpoint, "application/json", bytes.NewBuffer(testEventBytes))
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+	}()
+
+	logLines, _ := logs.AwaitFunctionLogs()
+
+	assert.Equal(t, 2, len(logLines))
+	assert.Equal(t, "function log line", string(logLines[0].Content))
+	assert.False(t, logLines[0].Extension)
+	assert.Equal(t, "extension log line", string(logLines[1].Content))
+	assert.True(t, logLines[1].Extension)
+
+	assert.Nil(t, logs.Close())
+}
+
 func TestFunctionLogs(t *testing.T) {
-	logs, err := startInternal("localhost")
+	logs, err := startInternal("localhost", &http.Server{})
 	assert.NoError(t, err)
 
 	testEvents := []api.LogEvent{
@@ -198,8 +286,104 @@ func TestFunctionLogs(t *testing.T) {
 	assert.Nil(t, logs.Close())
 }
 
+func TestLargeBatch(t *testing.T) {
+	logs, err := startInternal("localhost", &http.Server{})
+	assert.NoError(t, err)
+
+	const eventCount = 10000
+
+	// Stream the batch, one event at a time, and cut it off mid-event
+	body, writer := io.Pipe()
+	go func() {
+		encoder := json.NewEncoder(writer)
+		_, _ = writer.Write([]byte("["))
+		for i := 0; i < eventCount; i++ {
+			if i > 0 {
+				_, _ = writer.Write([]byte(","))
+			}
+			_ = encoder.Encode(api.LogEvent{
+				Time:   time.Now(),
+				Type:   "function",
+				Record: fmt.Sprintf("log line %d", i),
+			})
+		}
+		_, _ = writer.Write([]byte(`,{"time": "2020-11`))
+		_ = writer.Close()
+	}()
+
+	realEndpoint := fmt.Sprintf("http://localhost:%d", logs.Port())
+	req, err := http.NewRequest("POST", realEndpoint, body)
+	assert.NoError(t, err)
+
+	client := http.Client{}
+	go func() {
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+	}()
+
+	// The batch arrives in chunks, while it is still being read
+	var logLines []LogLine
+	chunks := 0
+	for len(logLines) < eventCount {
+		chunk, _ := logs.AwaitFunctionLogs()
+		assert.True(t, len(chunk) <= functionLogChunkLines)
+		logLines = append(logLines, chunk...)
+		chunks++
+	}
+
+	assert.Equal(t, eventCount/functionLogChunkLines, chunks)
+	assert.Equal(t, eventCount, len(logLines))
+	assert.Equal(t, "log line 0", string(logLines[0].Content))
+	assert.Equal(t, fmt.Sprintf("log line %d", eventCount-1), string(logLines[eventCount-1].Content))
+
+	assert.Nil(t, logs.Close())
+}
+
 func TestLogServerStart(t *testing.T) {
 	logs, err := Start(&config.Configuration{LogServerHost: "localhost"})
 	assert.NoError(t, err)
 	assert.Nil(t, logs.Close())
 }
+
+func TestLogServerStartLoopback(t *testing.T) {
+	logs, err := Start(&config.Configuration{LogServerHost: "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", logs.Port()), logs.listenString)
+	assert.Nil(t, logs.Close())
+}
+
+func TestLogServerStartIPv6Loopback(t *testing.T) {
+	if listener, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback is unavailable:", err)
+	} else {
+		_ = listener.Close()
+	}
+
+	logs, err := Start(&config.Configuration{LogServerHost: "::1"})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("[::1]:%d", logs.Port()), logs.listenString)
+	assert.Nil(t, logs.Close())
+}
+
+func TestLogServerStartTimeouts(t *testing.T) {
+	logs, err := Start(&config.Configuration{LogServerHost: "localhost"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), logs.server.ReadTimeout)
+	assert.Equal(t, time.Duration(0), logs.server.ReadHeaderTimeout)
+	assert.Nil(t, logs.Close())
+
+	logs, err = Start(&config.Configuration{LogServerHost: "localhost", LogReadTimeoutMillis: 5000, LogReadHeaderMillis: 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, logs.server.ReadTimeout)
+	assert.Equal(t, time.Second, logs.server.ReadHeaderTimeout)
+	assert.Nil(t, logs.Close())
+}
+
+func TestLogServerStartInvalidHost(t *testing.T) {
+	for _, host := range []string{"", "localhost:8080", "http://localhost", "sandbox .localdomain"} {
+		logs, err := Start(&config.Configuration{LogServerHost: host})
+		assert.Error(t, err, host)
+		assert.Nil(t, logs)
+	}
+}
@@ -22,7 +22,17 @@ import (
 	"github.com/newrelic/newrelic-lambda-extension/telemetry"
 )
 
+const (
+	maxNextEventAttempts = 5
+
+	// logDeliveryWatchInvokes is how many invocations in a row must pass without a log delivery before re-subscribing
+	logDeliveryWatchInvokes = 3
+)
+
 var (
+	// nextEventBackoff is the delay after the first failed call to next; it doubles with each further failure
+	nextEventBackoff = 100 * time.Millisecond
+
 	invokedFunctionARN string
 	lastEventStart     time.Time
 	lastRequestId      string
@@ -64,6 +74,10 @@ func main() {
 	// Optionally enable debug logging, disabled by default
 	util.ConfigLogger(conf.LogsEnabled, conf.LogLevel == config.DebugLogLevel)
 
+	if conf.LogEffectiveConfig {
+		util.Logf("Effective configuration: %s\n", conf.Redacted())
+	}
+
 	// Extensions must register
 	registrationClient := client.New(http.Client{})
 
@@ -86,6 +100,15 @@ func main() {
 	// Attempt to find the license key for telemetry sending
 	licenseKey, err := credentials.GetNewRelicLicenseKey(ctx, conf)
 	if err != nil {
+		if conf.RequireLicenseKey {
+			err2 := invocationClient.InitError(ctx, "licenseKey.missing", err)
+			if err2 != nil {
+				util.Logln(err2)
+			}
+			util.Panic("A New Relic license key is required (NEW_RELIC_REQUIRE_LICENSE_KEY), but could not be retrieved. "+
+				"Set NEW_RELIC_LICENSE_KEY or NEW_RELIC_LICENSE_KEY_FILE, or set NEW_RELIC_LICENSE_KEY_SECRET to a Secrets Manager secret with a LicenseKey attribute: ", err)
+		}
+
 		util.Logln("Failed to retrieve New Relic license key", err)
 		// We fail open; telemetry will go to CloudWatch instead
 		noopLoop(ctx, invocationClient)
@@ -93,7 +116,7 @@ func main() {
 	}
 
 	// Set up the telemetry buffer
-	batch := telemetry.NewBatch(int64(conf.RipeMillis), int64(conf.RotMillis), conf.CollectTraceID)
+	batch := telemetry.NewBatch(conf)
 
 	// Start the Logs API server, and register it
 	logServer, err := logserver.Start(conf)
@@ -109,6 +132,9 @@ func main() {
 	if conf.SendFunctionLogs {
 		eventTypes = append(eventTypes, api.Function)
 	}
+	if conf.ForwardExtensionLogs {
+		eventTypes = append(eventTypes, api.Extension)
+	}
 	subscriptionRequest := api.DefaultLogSubscription(eventTypes, logServer.Port())
 	err = invocationClient.LogRegister(ctx, subscriptionRequest)
 	if err != nil {
@@ -120,7 +146,7 @@ func main() {
 	}
 
 	// Init the telemetry sending client
-	telemetryClient := telemetry.New(registrationResponse.FunctionName, licenseKey, conf.TelemetryEndpoint, conf.LogEndpoint, batch, conf.CollectTraceID)
+	telemetryClient := telemetry.New(conf, registrationResponse.FunctionName, licenseKey, batch)
 	telemetryChan, err := telemetry.InitTelemetryChannel()
 	if err != nil {
 		err2 := invocationClient.InitError(ctx, "telemetryClient.init", err)
@@ -144,8 +170,21 @@ func main() {
 		logShipLoop(ctx, logServer, telemetryClient)
 	}()
 
+	// Resend anything a previous sandbox spilled to disk
+	if conf.SpillDir != "" {
+		backgroundTasks.Add(1)
+		go func() {
+			defer backgroundTasks.Done()
+			telemetryClient.SendSpilled(ctx)
+		}()
+	}
+
 	// Call next, and process telemetry, until we're shut down
-	eventCounter := mainLoop(ctx, invocationClient, batch, telemetryChan, logServer, telemetryClient)
+	deliveryWatch := &logDeliveryWatch{
+		gap:          time.Duration(conf.LogDeliveryGapMillis) * time.Millisecond,
+		subscription: subscriptionRequest,
+	}
+	eventCounter, nextEventErr := mainLoop(ctx, invocationClient, batch, telemetryChan, logServer, telemetryClient, conf, deliveryWatch)
 
 	util.Logf("New Relic Extension shutting down after %v events\n", eventCounter)
 
@@ -158,14 +197,93 @@ func main() {
 	finalHarvest := batch.Close()
 	shipHarvest(ctx, finalHarvest, telemetryClient)
 
+	if dropped := batch.Dropped(); dropped > 0 {
+		util.Logf("Dropped telemetry for %d invocations because the batch was full\n", dropped)
+	}
+
+	if malformed := logServer.MalformedMetrics(); len(malformed) > 0 {
+		util.Logf("Left malformed metrics out of platform reports: %v\n", malformed)
+	}
+
+	if throttled := client.ThrottledRequests(); throttled > 0 {
+		util.Logf("The Extensions API throttled %d requests\n", throttled)
+	}
+
 	util.Debugln("Waiting for background tasks to complete")
 	backgroundTasks.Wait()
 
+	// The shutdown summary is the final flush, so that it covers everything sent before it
+	err = telemetryClient.SendShutdownSummary(ctx, invokedFunctionARN, time.Since(extensionStartup))
+	if err != nil {
+		util.Logln("Failed to send shutdown summary", err)
+	}
+	telemetryClient.WaitForWebhooks()
+
+	// Only report a failed next once everything has been flushed, since the extension is stopped soon after
+	if nextEventErr != nil {
+		err = invocationClient.ExitError(ctx, "NextEventError.Main", nextEventErr)
+		if err != nil {
+			util.Logln(err)
+		}
+	}
+
 	shutdownAt := time.Now()
 	ranFor := shutdownAt.Sub(extensionStartup)
 	util.Logf("Extension shutdown after %vms", ranFor.Milliseconds())
 }
 
+// logDeliveryWatch re-subscribes to the Logs API if logs stop arriving while invocations continue. A zero gap disables it.
+type logDeliveryWatch struct {
+	gap          time.Duration
+	subscription *api.LogSubscription
+	lastAttempt  time.Time
+	lastDelivery time.Time
+	// invokes counts the invocations since the last delivery or re-subscription attempt
+	invokes int
+}
+
+// check is called once per invocation. It re-subscribes if logDeliveryWatchInvokes invocations have passed without a log
+// delivery, and there has been no delivery, nor re-subscription attempt, within the gap. A function invoked less often
+// than the gap still gets its logs between invocations, so it isn't re-subscribed.
+func (w *logDeliveryWatch) check(ctx context.Context, invocationClient *client.InvocationClient, logServer *logserver.LogServer, now time.Time) {
+	if w.gap <= 0 {
+		return
+	}
+
+	delivery := logServer.LastDelivery()
+	if !delivery.Equal(w.lastDelivery) {
+		w.lastDelivery = delivery
+		w.invokes = 0
+	}
+	w.invokes++
+
+	since := delivery
+	if w.lastAttempt.After(since) {
+		since = w.lastAttempt
+	}
+	if w.invokes < logDeliveryWatchInvokes || now.Sub(since) <= w.gap {
+		return
+	}
+
+	util.Logf("No logs delivered for %v over %d invocations; re-subscribing to the Logs API\n", now.Sub(since), w.invokes)
+	w.lastAttempt = now
+	w.invokes = 0
+	err := invocationClient.LogRegister(ctx, w.subscription)
+	if err != nil {
+		util.Logln("Failed to re-subscribe to the Logs API", err)
+	}
+}
+
+// shouldShip reports whether harvested telemetry should be shipped during the given invocation. With harvestOnReport,
+// it is only shipped when platform reports have just arrived, so that sends line up with the ends of invocations.
+func shouldShip(eventCounter int, sendEveryN int, harvestOnReport bool, reports int) bool {
+	if harvestOnReport && reports == 0 {
+		return false
+	}
+
+	return sendEveryN <= 1 || eventCounter%sendEveryN == 0
+}
+
 // logShipLoop ships function logs to New Relic as they arrive.
 func logShipLoop(ctx context.Context, logServer *logserver.LogServer, telemetryClient *telemetry.Client) {
 	for {
@@ -182,15 +300,21 @@ func logShipLoop(ctx context.Context, logServer *logserver.LogServer, telemetryC
 }
 
 // mainLoop repeatedly calls the /next api, and processes telemetry and platform logs. The timing is rather complicated.
-func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, batch *telemetry.Batch, telemetryChan chan []byte, logServer *logserver.LogServer, telemetryClient *telemetry.Client) int {
+// Harvested telemetry is shipped on every invocation, or only on every SendEveryNInvokes-th invocation if that is greater
+// than one, and only once platform reports arrive if HarvestOnReport is set. Whatever remains is shipped at shutdown.
+// Failed calls to next are retried with backoff; after maxNextEventAttempts consecutive failures the loop returns the
+// error, so that main can flush before reporting it. With RunOnce, the loop returns after the first invocation.
+func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, batch *telemetry.Batch, telemetryChan chan []byte, logServer *logserver.LogServer, telemetryClient *telemetry.Client, conf *config.Configuration, deliveryWatch *logDeliveryWatch) (int, error) {
+	sendEveryN := int(conf.SendEveryNInvokes)
 	eventCounter := 0
+	nextEventFailures := 0
 	probablyTimeout := false
 
 	for {
 		select {
 		case <-ctx.Done():
 			// We're already done
-			return eventCounter
+			return eventCounter, nil
 		default:
 			// Our call to next blocks. It is likely that the container is frozen immediately after we call NextEvent.
 			event, err := invocationClient.NextEvent(ctx)
@@ -200,14 +324,22 @@ func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, ba
 
 			if err != nil {
 				util.Logln(err)
-				err = invocationClient.ExitError(ctx, "NextEventError.Main", err)
-				if err != nil {
-					util.Logln(err)
+				nextEventFailures++
+				if nextEventFailures >= maxNextEventAttempts {
+					util.Logf("Giving up after %d consecutive failed calls to next\n", nextEventFailures)
+					return eventCounter, err
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(nextEventBackoff << uint(nextEventFailures-1)):
 				}
 				continue
 			}
 
+			nextEventFailures = 0
 			eventCounter++
+			telemetryClient.ResetRetryBudget()
 
 			if probablyTimeout {
 				// We suspect a timeout. Either way, we've gotten to the next event, so telemetry will
@@ -242,7 +374,7 @@ func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, ba
 					batch.AddTelemetry(lastRequestId, []byte(errorMessage))
 				}
 
-				return eventCounter
+				return eventCounter, nil
 			} else {
 				// Reset probablyTimeout if the event after the suspected timeout wasn't a timeout shutdown.
 				probablyTimeout = false
@@ -255,6 +387,13 @@ func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, ba
 			// Create an invocation record to hold telemetry
 			batch.AddInvocation(lastRequestId, eventStart)
 
+			// Invocations continue; make sure logs do too
+			deliveryWatch.check(ctx, invocationClient, logServer, eventStart)
+
+			// Describe the sandbox once, now that the function ARN is known. Like the harvest below, this runs alongside
+			// the handler.
+			telemetryClient.SendEnvironment(ctx, invokedFunctionARN)
+
 			// Await agent telemetry, which may time out.
 
 			// timeoutInstant is when the invocation will time out
@@ -267,8 +406,10 @@ func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, ba
 			// Before we begin to await telemetry, harvest and ship. Ripe telemetry will mostly be handled here. Even that is a
 			// minority of invocations. Putting this here lets us run the HTTP request to send to NR in parallel with the Lambda
 			// handler, reducing or eliminating our latency impact.
-			pollLogServer(logServer, batch)
-			shipHarvest(ctx, batch.Harvest(time.Now()), telemetryClient)
+			reports := pollLogServer(logServer, batch)
+			if shouldShip(eventCounter, sendEveryN, conf.HarvestOnReport, reports) {
+				shipHarvest(ctx, batch.Harvest(time.Now()), telemetryClient)
+			}
 
 			select {
 			case <-timeLimitContext.Done():
@@ -276,6 +417,15 @@ func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, ba
 
 				// We are about to timeout
 				probablyTimeout = true
+				if conf.RunOnce {
+					// There's no next event to catch up on, so take any telemetry that made it, for the final harvest
+					select {
+					case telemetryBytes := <-telemetryChan:
+						batch.AddTelemetry(lastRequestId, telemetryBytes)
+					default:
+					}
+					return eventCounter, nil
+				}
 				continue
 			case telemetryBytes := <-telemetryChan:
 				timeLimitCancel()
@@ -289,33 +439,36 @@ func mainLoop(ctx context.Context, invocationClient *client.InvocationClient, ba
 
 				// Opportunity for an aggressive harvest, in which case, we definitely want to wait for the HTTP POST
 				// to complete. Mostly, nothing really happens here.
-				pollLogServer(logServer, batch)
-				shipHarvest(ctx, batch.Harvest(time.Now()), telemetryClient)
+				reports = pollLogServer(logServer, batch)
+				if shouldShip(eventCounter, sendEveryN, conf.HarvestOnReport, reports) {
+					shipHarvest(ctx, batch.Harvest(time.Now()), telemetryClient)
+				}
 			}
 
 			lastEventStart = eventStart
+			if conf.RunOnce {
+				return eventCounter, nil
+			}
 		}
 	}
 }
 
-// pollLogServer polls for platform logs, and annotates telemetry
-func pollLogServer(logServer *logserver.LogServer, batch *telemetry.Batch) {
-	for _, platformLog := range logServer.PollPlatformChannel() {
+// pollLogServer polls for platform logs, and annotates telemetry. It returns the number of platform reports received.
+func pollLogServer(logServer *logserver.LogServer, batch *telemetry.Batch) int {
+	platformLogs := logServer.PollPlatformChannel()
+	for _, platformLog := range platformLogs {
 		inv := batch.AddTelemetry(platformLog.RequestID, platformLog.Content)
 		if inv == nil {
 			util.Debugf("Skipping platform log for request %v", platformLog.RequestID)
 		}
 	}
+
+	return len(platformLogs)
 }
 
 func shipHarvest(ctx context.Context, harvested []*telemetry.Invocation, telemetryClient *telemetry.Client) {
 	if len(harvested) > 0 {
-		telemetrySlice := make([][]byte, 0, 2*len(harvested))
-		for _, inv := range harvested {
-			telemetrySlice = append(telemetrySlice, inv.Telemetry...)
-		}
-
-		err, _ := telemetryClient.SendTelemetry(ctx, invokedFunctionARN, telemetrySlice)
+		err, _ := telemetryClient.SendInvocations(ctx, invokedFunctionARN, harvested)
 		if err != nil {
 			util.Logf("Failed to send harvested telemetry for %d invocations %s", len(harvested), err)
 		}
@@ -4,16 +4,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/newrelic/newrelic-lambda-extension/config"
 	"github.com/newrelic/newrelic-lambda-extension/lambda/extension/api"
+	"github.com/newrelic/newrelic-lambda-extension/lambda/extension/client"
+	"github.com/newrelic/newrelic-lambda-extension/lambda/logserver"
 	"github.com/newrelic/newrelic-lambda-extension/util"
 
 	"github.com/stretchr/testify/assert"
@@ -354,6 +360,92 @@ func TestMainNoLicenseKey(t *testing.T) {
 	assert.Equal(t, 1, nextEventRequestCount)
 }
 
+func TestMainNoLicenseKeyRequired(t *testing.T) {
+	var (
+		registerRequestCount    int
+		initErrorRequestCount   int
+		exitErrorRequestCount   int
+		logRegisterRequestCount int
+		nextEventRequestCount   int
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		util.Logln("Path: ", r.URL.Path)
+		defer util.Close(r.Body)
+
+		if r.URL.Path == "/2020-01-01/extension/register" {
+			registerRequestCount++
+
+			w.Header().Add(api.ExtensionIdHeader, "test-ext-id")
+			w.WriteHeader(200)
+			res, err := json.Marshal(api.RegistrationResponse{
+				FunctionName:    "foobar",
+				FunctionVersion: "latest",
+				Handler:         "lambda.handler",
+			})
+			assert.Nil(t, err)
+			_, _ = w.Write(res)
+		}
+
+		if r.URL.Path == "/2020-01-01/extension/init/error" {
+			initErrorRequestCount++
+
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(""))
+		}
+
+		if r.URL.Path == "/2020-01-01/extension/exit/error" {
+			exitErrorRequestCount++
+
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(""))
+		}
+
+		if r.URL.Path == "/2020-08-15/logs" {
+			logRegisterRequestCount++
+
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(""))
+		}
+
+		if r.URL.Path == "/2020-01-01/extension/event/next" {
+			nextEventRequestCount++
+
+			w.WriteHeader(200)
+			res, err := json.Marshal(api.InvocationEvent{
+				EventType:          api.Shutdown,
+				DeadlineMs:         1,
+				RequestID:          "12345",
+				InvokedFunctionARN: "arn:aws:lambda:us-east-1:12345:foobar",
+				ShutdownReason:     api.Timeout,
+				Tracing:            nil,
+			})
+			assert.Nil(t, err)
+			_, _ = w.Write(res)
+		}
+	}))
+	defer srv.Close()
+
+	url := srv.URL[7:]
+
+	_ = os.Setenv(api.LambdaHostPortEnvVar, url)
+	defer os.Unsetenv(api.LambdaHostPortEnvVar)
+
+	_ = os.Setenv("NEW_RELIC_EXTENSION_LOG_LEVEL", "DEBUG")
+	defer os.Unsetenv("NEW_RELIC_EXTENSION_LOG_LEVEL")
+
+	_ = os.Setenv("NEW_RELIC_REQUIRE_LICENSE_KEY", "true")
+	defer os.Unsetenv("NEW_RELIC_REQUIRE_LICENSE_KEY")
+
+	assert.Panics(t, main)
+
+	assert.Equal(t, 1, registerRequestCount)
+	assert.Equal(t, 1, initErrorRequestCount)
+	assert.Equal(t, 0, exitErrorRequestCount)
+	assert.Equal(t, 0, logRegisterRequestCount)
+	assert.Equal(t, 0, nextEventRequestCount)
+}
+
 func TestMainExtensionDisabled(t *testing.T) {
 	var (
 		registerRequestCount    int
@@ -751,3 +843,332 @@ func TestMainTimeoutNoPipeWrite(t *testing.T) {
 func overrideContext(ctx context.Context) {
 	rootCtx = ctx
 }
+
+func TestShouldShip(t *testing.T) {
+	for eventCounter := 1; eventCounter <= 6; eventCounter++ {
+		assert.True(t, shouldShip(eventCounter, 0, false, 0))
+		assert.True(t, shouldShip(eventCounter, 1, false, 0))
+	}
+
+	var shipped []int
+	for eventCounter := 1; eventCounter <= 10; eventCounter++ {
+		if shouldShip(eventCounter, 3, false, 0) {
+			shipped = append(shipped, eventCounter)
+		}
+	}
+	assert.Equal(t, []int{3, 6, 9}, shipped)
+}
+
+func TestShouldShipOnReport(t *testing.T) {
+	// Reports arrive for the previous invocation, at the start of the next
+	reports := []int{0, 1, 0, 2, 1, 0}
+
+	var shipped []int
+	for eventCounter := 1; eventCounter <= len(reports); eventCounter++ {
+		if shouldShip(eventCounter, 0, true, reports[eventCounter-1]) {
+			shipped = append(shipped, eventCounter)
+		}
+	}
+	assert.Equal(t, []int{2, 4, 5}, shipped)
+
+	shipped = nil
+	for eventCounter := 1; eventCounter <= len(reports); eventCounter++ {
+		if shouldShip(eventCounter, 2, true, reports[eventCounter-1]) {
+			shipped = append(shipped, eventCounter)
+		}
+	}
+	assert.Equal(t, []int{2, 4}, shipped)
+}
+
+func TestLogDeliveryWatch(t *testing.T) {
+	var logRegisterRequestCount int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		if r.URL.Path == "/2020-01-01/extension/register" {
+			w.Header().Add(api.ExtensionIdHeader, "test-ext-id")
+			w.WriteHeader(200)
+			res, err := json.Marshal(api.RegistrationResponse{FunctionName: "foobar"})
+			assert.Nil(t, err)
+			_, _ = w.Write(res)
+		}
+
+		if r.URL.Path == "/2020-08-15/logs" {
+			logRegisterRequestCount++
+
+			w.WriteHeader(200)
+			_, _ = w.Write(nil)
+		}
+	}))
+	defer srv.Close()
+
+	_ = os.Setenv(api.LambdaHostPortEnvVar, srv.URL[7:])
+	defer os.Unsetenv(api.LambdaHostPortEnvVar)
+
+	ctx := context.Background()
+	invocationClient, _, err := client.New(http.Client{}).RegisterDefault(ctx)
+	assert.NoError(t, err)
+
+	logServer, err := logserver.Start(&config.Configuration{LogServerHost: "localhost"})
+	assert.NoError(t, err)
+	defer util.Close(logServer)
+
+	subscription := api.DefaultLogSubscription([]api.LogEventType{api.Platform}, logServer.Port())
+	deliver := func() time.Time {
+		res, err := http.Post(fmt.Sprintf("http://localhost:%d", logServer.Port()), "application/json", bytes.NewBufferString("[]"))
+		assert.NoError(t, err)
+		util.Close(res.Body)
+		return logServer.LastDelivery()
+	}
+
+	// Disabled
+	disabled := &logDeliveryWatch{subscription: subscription}
+	for i := 0; i < logDeliveryWatchInvokes; i++ {
+		disabled.check(ctx, invocationClient, logServer, logServer.LastDelivery().Add(time.Hour))
+	}
+	assert.Equal(t, 0, logRegisterRequestCount)
+
+	watch := &logDeliveryWatch{gap: time.Minute, subscription: subscription}
+
+	// Invoked less often than the gap, with logs delivered between invocations
+	for i := 0; i < 2*logDeliveryWatchInvokes; i++ {
+		watch.check(ctx, invocationClient, logServer, deliver().Add(time.Hour))
+	}
+	assert.Equal(t, 0, logRegisterRequestCount)
+
+	// Invocations without deliveries, but within the gap
+	delivered := deliver()
+	for i := 0; i < 2*logDeliveryWatchInvokes; i++ {
+		watch.check(ctx, invocationClient, logServer, delivered.Add(30*time.Second))
+	}
+	assert.Equal(t, 0, logRegisterRequestCount)
+
+	// Invocations without deliveries, past the gap
+	delivered = deliver()
+	for i := 1; i < logDeliveryWatchInvokes; i++ {
+		watch.check(ctx, invocationClient, logServer, delivered.Add(2*time.Minute))
+		assert.Equal(t, 0, logRegisterRequestCount)
+	}
+	watch.check(ctx, invocationClient, logServer, delivered.Add(2*time.Minute))
+	assert.Equal(t, 1, logRegisterRequestCount)
+
+	// The re-subscription attempt restarts the invocation count
+	for i := 1; i < logDeliveryWatchInvokes; i++ {
+		watch.check(ctx, invocationClient, logServer, delivered.Add(4*time.Minute))
+	}
+	assert.Equal(t, 1, logRegisterRequestCount)
+	watch.check(ctx, invocationClient, logServer, delivered.Add(4*time.Minute))
+	assert.Equal(t, 2, logRegisterRequestCount)
+
+	// It also restarts the gap
+	for i := 0; i < logDeliveryWatchInvokes; i++ {
+		watch.check(ctx, invocationClient, logServer, delivered.Add(4*time.Minute+30*time.Second))
+	}
+	assert.Equal(t, 2, logRegisterRequestCount)
+	watch.check(ctx, invocationClient, logServer, delivered.Add(6*time.Minute))
+	assert.Equal(t, 3, logRegisterRequestCount)
+}
+
+func TestMainNextEventRetry(t *testing.T) {
+	defer func(backoff time.Duration) { nextEventBackoff = backoff }(nextEventBackoff)
+	nextEventBackoff = time.Millisecond
+
+	defer func(ctx context.Context) { rootCtx = ctx }(rootCtx)
+	rootCtx = context.Background()
+
+	for _, tc := range []struct {
+		name              string
+		status            int
+		failures          int
+		expectedNextCount int
+		expectedExitCount int
+	}{
+		{"transient", http.StatusServiceUnavailable, 2, 3, 0},
+		{"persistent", http.StatusServiceUnavailable, 100, maxNextEventAttempts, 1},
+		{"transient server error", http.StatusInternalServerError, 2, 3, 0},
+		{"persistent server error", http.StatusInternalServerError, 100, maxNextEventAttempts, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				exitErrorRequestCount int
+				nextEventRequestCount int
+				logServerURI          string
+			)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer util.Close(r.Body)
+
+				if r.URL.Path == "/2020-01-01/extension/register" {
+					w.Header().Add(api.ExtensionIdHeader, "test-ext-id")
+					w.WriteHeader(200)
+					res, err := json.Marshal(api.RegistrationResponse{
+						FunctionName:    "foobar",
+						FunctionVersion: "latest",
+						Handler:         "lambda.handler",
+					})
+					assert.Nil(t, err)
+					_, _ = w.Write(res)
+				}
+
+				if r.URL.Path == "/2020-01-01/extension/exit/error" {
+					exitErrorRequestCount++
+
+					// Buffered telemetry is flushed, and the log server closed, before the error is reported
+					assert.NotEmpty(t, logServerURI)
+					_, err := http.Post(logServerURI, "application/json", bytes.NewBufferString("[]"))
+					assert.Error(t, err)
+
+					w.WriteHeader(200)
+				}
+
+				if r.URL.Path == "/2020-08-15/logs" {
+					var subscription api.LogSubscription
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&subscription))
+					logServerURI = strings.Replace(subscription.Destination.URI, "sandbox", "localhost", 1)
+
+					w.WriteHeader(200)
+				}
+
+				if r.URL.Path == "/2020-01-01/extension/event/next" {
+					nextEventRequestCount++
+					if nextEventRequestCount <= tc.failures {
+						w.WriteHeader(tc.status)
+						return
+					}
+
+					w.WriteHeader(200)
+					res, err := json.Marshal(api.InvocationEvent{
+						EventType:      api.Shutdown,
+						DeadlineMs:     1,
+						ShutdownReason: api.Spindown,
+					})
+					assert.Nil(t, err)
+					_, _ = w.Write(res)
+				}
+			}))
+			defer srv.Close()
+
+			_ = os.Setenv(api.LambdaHostPortEnvVar, srv.URL[7:])
+			defer os.Unsetenv(api.LambdaHostPortEnvVar)
+
+			_ = os.Setenv("NEW_RELIC_LICENSE_KEY", "foobar")
+			defer os.Unsetenv("NEW_RELIC_LICENSE_KEY")
+
+			_ = os.Setenv("NEW_RELIC_LOG_SERVER_HOST", "localhost")
+			defer os.Unsetenv("NEW_RELIC_LOG_SERVER_HOST")
+
+			assert.NotPanics(t, main)
+
+			assert.Equal(t, tc.expectedNextCount, nextEventRequestCount)
+			assert.Equal(t, tc.expectedExitCount, exitErrorRequestCount)
+		})
+	}
+}
+
+func TestMainRunOnce(t *testing.T) {
+	var (
+		exitErrorRequestCount int
+		nextEventRequestCount int
+		telemetryBodies       []string
+	)
+
+	defer func(ctx context.Context) { rootCtx = ctx }(rootCtx)
+	rootCtx = context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		if r.URL.Path == "/2020-01-01/extension/register" {
+			w.Header().Add(api.ExtensionIdHeader, "test-ext-id")
+			w.WriteHeader(200)
+			res, err := json.Marshal(api.RegistrationResponse{
+				FunctionName:    "foobar",
+				FunctionVersion: "latest",
+				Handler:         "lambda.handler",
+			})
+			assert.Nil(t, err)
+			_, _ = w.Write(res)
+		}
+
+		if r.URL.Path == "/2020-01-01/extension/exit/error" {
+			exitErrorRequestCount++
+			w.WriteHeader(200)
+		}
+
+		if r.URL.Path == "/2020-08-15/logs" {
+			w.WriteHeader(200)
+		}
+
+		// Invocations never stop coming, so only run once mode ends the loop
+		if r.URL.Path == "/2020-01-01/extension/event/next" {
+			nextEventRequestCount++
+
+			w.WriteHeader(200)
+			res, err := json.Marshal(api.InvocationEvent{
+				EventType:          api.Invoke,
+				DeadlineMs:         time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond),
+				RequestID:          "12345",
+				InvokedFunctionARN: "arn:aws:lambda:us-east-1:12345:foobar",
+			})
+			assert.Nil(t, err)
+			_, _ = w.Write(res)
+		}
+
+		if r.URL.Path == "/aws/lambda/v1" {
+			reqBytes, err := ioutil.ReadAll(r.Body)
+			assert.Nil(t, err)
+			reqBody, err := util.Uncompress(reqBytes)
+			assert.Nil(t, err)
+			telemetryBodies = append(telemetryBodies, string(reqBody))
+			w.WriteHeader(200)
+		}
+	}))
+	defer srv.Close()
+
+	_ = os.Setenv(api.LambdaHostPortEnvVar, srv.URL[7:])
+	defer os.Unsetenv(api.LambdaHostPortEnvVar)
+
+	_ = os.Setenv("NEW_RELIC_LICENSE_KEY", "foobar")
+	defer os.Unsetenv("NEW_RELIC_LICENSE_KEY")
+
+	_ = os.Setenv("NEW_RELIC_LOG_SERVER_HOST", "localhost")
+	defer os.Unsetenv("NEW_RELIC_LOG_SERVER_HOST")
+
+	_ = os.Setenv("NEW_RELIC_RUN_ONCE", "true")
+	defer os.Unsetenv("NEW_RELIC_RUN_ONCE")
+
+	_ = os.Setenv("NEW_RELIC_TELEMETRY_ENDPOINT", fmt.Sprintf("%s/aws/lambda/v1", srv.URL))
+	defer os.Unsetenv("NEW_RELIC_TELEMETRY_ENDPOINT")
+
+	// Never ship from the loop, so that the telemetry can only be sent by the final harvest
+	_ = os.Setenv("NEW_RELIC_SEND_EVERY_N_INVOKES", "1000")
+	defer os.Unsetenv("NEW_RELIC_SEND_EVERY_N_INVOKES")
+
+	_ = os.Remove("/tmp/newrelic-telemetry")
+
+	go func() {
+		for {
+			if _, err := os.Stat("/tmp/newrelic-telemetry"); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		pipe, err := os.OpenFile("/tmp/newrelic-telemetry", os.O_WRONLY, 0)
+		assert.Nil(t, err)
+		defer pipe.Close()
+
+		_, _ = pipe.WriteString("foobar\n")
+	}()
+
+	assert.NotPanics(t, main)
+
+	assert.Equal(t, 1, nextEventRequestCount)
+	assert.Equal(t, 0, exitErrorRequestCount)
+
+	// The invocation's telemetry, and then the shutdown summary
+	if assert.Equal(t, 2, len(telemetryBodies)) {
+		assert.Contains(t, telemetryBodies[0], `\"message\":\"foobar`)
+	}
+}
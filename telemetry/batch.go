@@ -2,8 +2,10 @@ package telemetry
 
 import (
 	"math"
+	"math/rand"
 	"time"
 
+	"github.com/newrelic/newrelic-lambda-extension/config"
 	"github.com/newrelic/newrelic-lambda-extension/util"
 )
 
@@ -12,38 +14,118 @@ var epochStart = time.Unix(0, 0)
 
 // Batch represents the unsent invocations and their telemetry, along with timing data.
 type Batch struct {
-	lastHarvest     time.Time
-	eldest          time.Time
-	invocations     map[string]*Invocation
-	ripeDuration    time.Duration
-	veryOldDuration time.Duration
-	extractTraceID  bool
+	lastHarvest       time.Time
+	eldest            time.Time
+	invocations       map[string]*Invocation
+	ripeDuration      time.Duration
+	veryOldDuration   time.Duration
+	firstHarvestDelay time.Duration
+	flushBytes        int
+	pendingBytes      int
+	maxInvocations    int
+	dropped           int
+	ripeJitter        time.Duration
+	currentRipe       time.Duration
+	random            *rand.Rand
+	extractTraceID    bool
 }
 
-// NewBatch constructs a new batch.
-func NewBatch(ripeMillis, rotMillis int64, extractTraceID bool) *Batch {
+// NewBatch constructs a new batch, which harvests telemetry once it is RipeMillis old, and everything once RotMillis
+// have passed since the last harvest. A non-zero FirstSendDelayMillis holds back the very first harvest, so that the
+// first invocation after a cold start doesn't send a tiny payload. A non-zero BatchFlushBytes harvests everything once
+// the batch holds at least that many bytes of telemetry, regardless of timing. A non-zero MaxInvocations caps the number
+// of invocations held; beyond it, the oldest invocation is dropped to make room. A non-zero HarvestJitterMillis adds up
+// to that much random delay to each ripe harvest, so that a fleet of sandboxes doesn't send in lockstep. It is capped at
+// half of RipeMillis. With CollectTraceID, trace IDs are extracted from agent payloads.
+func NewBatch(conf *config.Configuration) *Batch {
+	ripeMillis := int64(conf.RipeMillis)
+	ripeJitterMillis := int64(conf.HarvestJitterMillis)
 	initialSize := uint32(math.Min(float64(ripeMillis)/100, 100))
-	return &Batch{
-		lastHarvest:     epochStart,
-		eldest:          epochStart,
-		invocations:     make(map[string]*Invocation, initialSize),
-		ripeDuration:    time.Duration(ripeMillis) * time.Millisecond,
-		veryOldDuration: time.Duration(rotMillis) * time.Millisecond,
-		extractTraceID:  extractTraceID,
+	if ripeJitterMillis > ripeMillis/2 {
+		ripeJitterMillis = ripeMillis / 2
 	}
+	b := &Batch{
+		lastHarvest:       epochStart,
+		eldest:            epochStart,
+		invocations:       make(map[string]*Invocation, initialSize),
+		ripeDuration:      time.Duration(ripeMillis) * time.Millisecond,
+		veryOldDuration:   time.Duration(conf.RotMillis) * time.Millisecond,
+		firstHarvestDelay: time.Duration(conf.FirstSendDelayMillis) * time.Millisecond,
+		flushBytes:        int(conf.BatchFlushBytes),
+		maxInvocations:    int(conf.MaxInvocations),
+		ripeJitter:        time.Duration(ripeJitterMillis) * time.Millisecond,
+		random:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		extractTraceID:    conf.CollectTraceID,
+	}
+	b.currentRipe = b.jitteredRipeDuration()
+	return b
+}
+
+// jitteredRipeDuration returns the ripe duration, plus a random jitter of at most ripeJitter
+func (b *Batch) jitteredRipeDuration() time.Duration {
+	if b.ripeJitter <= 0 {
+		return b.ripeDuration
+	}
+	return b.ripeDuration + time.Duration(b.random.Int63n(int64(b.ripeJitter)+1))
 }
 
 // AddInvocation should be called just after the next API response. It creates the Invocation record so that we can attach telemetry later.
 func (b *Batch) AddInvocation(requestId string, start time.Time) {
+	if _, ok := b.invocations[requestId]; !ok && b.maxInvocations > 0 {
+		for len(b.invocations) >= b.maxInvocations {
+			b.evictOldest()
+		}
+	}
 	invocation := NewInvocation(requestId, start)
 	b.invocations[requestId] = &invocation
 }
 
+// evictOldest drops the invocation that started first, along with its telemetry. Invocations without telemetry are
+// evicted first, since nothing is lost with them.
+func (b *Batch) evictOldest() {
+	var oldest *Invocation
+	for _, v := range b.invocations {
+		if oldest == nil || (v.IsEmpty() && !oldest.IsEmpty()) || (v.IsEmpty() == oldest.IsEmpty() && v.Start.Before(oldest.Start)) {
+			oldest = v
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	delete(b.invocations, oldest.RequestId)
+	if oldest.IsEmpty() {
+		util.Debugf("Batch is full; dropped invocation %s, which had no telemetry\n", oldest.RequestId)
+		return
+	}
+
+	b.pendingBytes -= oldest.Size()
+	b.dropped++
+	util.Debugf("Batch is full; dropped invocation %s\n", oldest.RequestId)
+
+	if !oldest.IsEmpty() && !oldest.Start.After(b.eldest) {
+		newEldest := epochStart
+		for _, v := range b.invocations {
+			if !v.IsEmpty() && (newEldest.Equal(epochStart) || v.Start.Before(newEldest)) {
+				newEldest = v.Start
+			}
+		}
+		b.eldest = newEldest
+	}
+}
+
+// Dropped is the number of invocations whose telemetry was evicted because the batch was full
+func (b *Batch) Dropped() int {
+	return b.dropped
+}
+
 // AddTelemetry attaches telemetry to an existing Invocation, identified by requestId
 func (b *Batch) AddTelemetry(requestId string, telemetry []byte) *Invocation {
 	inv, ok := b.invocations[requestId]
 	if ok {
 		inv.Telemetry = append(inv.Telemetry, telemetry)
+		inv.records = append(inv.records, countTelemetry(telemetry))
+		b.pendingBytes += len(telemetry)
 		if b.eldest.Equal(epochStart) {
 			b.eldest = inv.Start
 		}
@@ -68,12 +150,22 @@ func (b *Batch) Harvest(now time.Time) []*Invocation {
 		return nil
 	}
 
+	if b.flushBytes > 0 && b.pendingBytes >= b.flushBytes {
+		util.Debugf("Batch holds %d bytes of telemetry, flushing", b.pendingBytes)
+		return b.aggressiveHarvest(now)
+	}
+
+	// Until the first harvest happens, wait out the first harvest delay, measured from the eldest telemetry
+	if b.lastHarvest.Equal(epochStart) && b.firstHarvestDelay > 0 && !b.eldest.Equal(epochStart) && now.Before(b.eldest.Add(b.firstHarvestDelay)) {
+		return nil
+	}
+
 	veryOldTime := now.Add(-b.veryOldDuration)
 	if b.lastHarvest.Before(veryOldTime) {
 		return b.aggressiveHarvest(now)
 	}
 
-	ripeTime := now.Add(-b.ripeDuration)
+	ripeTime := now.Add(-b.currentRipe)
 	if b.eldest.Before(ripeTime) {
 		return b.ripeHarvest(now)
 	}
@@ -98,6 +190,8 @@ func (b *Batch) aggressiveHarvest(now time.Time) []*Invocation {
 	if len(ret) > 0 {
 		b.lastHarvest = now
 		b.eldest = epochStart
+		b.pendingBytes = 0
+		b.currentRipe = b.jitteredRipeDuration()
 	}
 	util.Debugf("Aggressive harvest yielded %d invocations\n", len(ret))
 	return ret
@@ -111,6 +205,7 @@ func (b *Batch) ripeHarvest(now time.Time) []*Invocation {
 		if v.IsRipe() {
 			ret = append(ret, v)
 			delete(b.invocations, k)
+			b.pendingBytes -= v.Size()
 		} else if newEldest.Equal(epochStart) || v.Start.Before(newEldest) {
 			newEldest = v.Start
 		}
@@ -118,6 +213,7 @@ func (b *Batch) ripeHarvest(now time.Time) []*Invocation {
 	b.eldest = newEldest
 	if len(ret) > 0 {
 		b.lastHarvest = now
+		b.currentRipe = b.jitteredRipeDuration()
 	}
 	util.Debugf("Ripe harvest yielded %d invocations\n", len(ret))
 	return ret
@@ -129,6 +225,8 @@ type Invocation struct {
 	RequestId string
 	TraceId   string
 	Telemetry [][]byte
+	// records counts the records of each telemetry payload, as it was added
+	records []RecordCounts
 }
 
 // NewInvocation creates an Invocation, which can hold telemetry
@@ -150,6 +248,23 @@ func (inv *Invocation) IsEmpty() bool {
 	return len(inv.Telemetry) == 0
 }
 
+// telemetryRecords returns the records counted in the i-th telemetry payload
+func (inv *Invocation) telemetryRecords(i int) RecordCounts {
+	if i < len(inv.records) {
+		return inv.records[i]
+	}
+	return RecordCounts{}
+}
+
+// Size is the total number of telemetry bytes held by the invocation
+func (inv *Invocation) Size() int {
+	size := 0
+	for _, t := range inv.Telemetry {
+		size += len(t)
+	}
+	return size
+}
+
 // RetrieveTraceID looks up a trace ID using the provided request ID
 func (b *Batch) RetrieveTraceID(requestId string) string {
 	inv, ok := b.invocations[requestId]
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/newrelic/newrelic-lambda-extension/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,21 +25,21 @@ var (
 )
 
 func TestMissingInvocation(t *testing.T) {
-	batch := NewBatch(ripe, rot, false)
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
 
 	invocation := batch.AddTelemetry(testNoSuchRequestId, bytes.NewBufferString(testTelemetry).Bytes())
 	assert.Nil(t, invocation)
 }
 
 func TestEmptyHarvest(t *testing.T) {
-	batch := NewBatch(ripe, rot, false)
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
 	res := batch.Harvest(requestStart)
 
 	assert.Nil(t, res)
 }
 
 func TestEmptyRotHarvest(t *testing.T) {
-	batch := NewBatch(ripe, rot, false)
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
 
 	batch.AddInvocation("test", requestStart)
 
@@ -48,7 +49,7 @@ func TestEmptyRotHarvest(t *testing.T) {
 }
 
 func TestEmptyRipeHarvest(t *testing.T) {
-	batch := NewBatch(ripe, rot, false)
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
 
 	batch.lastHarvest = requestStart.Add(-ripe)
 	batch.AddInvocation("test", requestStart)
@@ -59,7 +60,7 @@ func TestEmptyRipeHarvest(t *testing.T) {
 }
 
 func TestWithInvocationRipeHarvest(t *testing.T) {
-	batch := NewBatch(ripe, rot, false)
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
 
 	batch.lastHarvest = requestStart
 
@@ -82,7 +83,7 @@ func TestWithInvocationRipeHarvest(t *testing.T) {
 }
 
 func TestWithInvocationAggressiveHarvest(t *testing.T) {
-	batch := NewBatch(ripe, rot, false)
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
 
 	batch.AddInvocation(testRequestId, requestStart)
 	batch.AddInvocation(testRequestId2, requestStart.Add(100*time.Millisecond))
@@ -101,7 +102,7 @@ func TestWithInvocationAggressiveHarvest(t *testing.T) {
 }
 
 func TestBatch_Close(t *testing.T) {
-	batch := NewBatch(ripe, rot, false)
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
 
 	batch.AddInvocation(testRequestId, requestStart)
 	batch.AddInvocation(testRequestId2, requestStart.Add(100*time.Millisecond))
@@ -118,3 +119,110 @@ func TestBatch_Close(t *testing.T) {
 	harvested := batch.Close()
 	assert.Equal(t, 2, len(harvested))
 }
+
+func TestFirstHarvestDelay(t *testing.T) {
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot, FirstSendDelayMillis: 500})
+
+	batch.AddInvocation(testRequestId, requestStart)
+	batch.AddTelemetry(testRequestId, bytes.NewBufferString(testTelemetry).Bytes())
+
+	// Without a delay, the first harvest is aggressive, and would yield this invocation immediately
+	assert.Empty(t, batch.Harvest(requestStart.Add(100*time.Millisecond)))
+
+	harvested := batch.Harvest(requestStart.Add(600 * time.Millisecond))
+	assert.Equal(t, 1, len(harvested))
+	assert.Equal(t, testRequestId, harvested[0].RequestId)
+
+	// Subsequent harvests aren't deferred
+	secondStart := requestStart.Add(700 * time.Millisecond)
+	batch.AddInvocation(testRequestId2, secondStart)
+	batch.AddTelemetry(testRequestId2, bytes.NewBufferString(testTelemetry).Bytes())
+	batch.AddTelemetry(testRequestId2, bytes.NewBufferString(moreTestTelemetry).Bytes())
+
+	harvested = batch.Harvest(secondStart.Add(ripe*time.Millisecond + time.Millisecond))
+	assert.Equal(t, 1, len(harvested))
+	assert.Equal(t, testRequestId2, harvested[0].RequestId)
+}
+
+func TestFlushBytesHarvest(t *testing.T) {
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot, BatchFlushBytes: 20})
+
+	batch.lastHarvest = requestStart
+
+	batch.AddInvocation(testRequestId, requestStart)
+	batch.AddTelemetry(testRequestId, bytes.NewBufferString(testTelemetry).Bytes())
+
+	// Neither ripe nor very old, and below the byte threshold
+	assert.Empty(t, batch.Harvest(requestStart.Add(time.Millisecond)))
+
+	batch.AddInvocation(testRequestId2, requestStart.Add(time.Millisecond))
+	batch.AddTelemetry(testRequestId2, bytes.NewBufferString(testTelemetry).Bytes())
+	assert.Equal(t, 2*len(testTelemetry), batch.pendingBytes)
+
+	harvested := batch.Harvest(requestStart.Add(2 * time.Millisecond))
+	assert.Equal(t, 2, len(harvested))
+	assert.Equal(t, 0, batch.pendingBytes)
+}
+
+func TestMaxInvocations(t *testing.T) {
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot, MaxInvocations: 2})
+
+	batch.AddInvocation(testRequestId, requestStart)
+	batch.AddTelemetry(testRequestId, bytes.NewBufferString(testTelemetry).Bytes())
+	batch.AddInvocation(testRequestId2, requestStart.Add(time.Millisecond))
+	batch.AddTelemetry(testRequestId2, bytes.NewBufferString(moreTestTelemetry).Bytes())
+	assert.Equal(t, 0, batch.Dropped())
+	assert.Equal(t, requestStart, batch.eldest)
+
+	batch.AddInvocation(testRequestId3, requestStart.Add(2*time.Millisecond))
+	assert.Equal(t, 1, batch.Dropped())
+	assert.Equal(t, 2, len(batch.invocations))
+	assert.Nil(t, batch.AddTelemetry(testRequestId, bytes.NewBufferString(testTelemetry).Bytes()))
+	assert.Equal(t, len(moreTestTelemetry), batch.pendingBytes)
+	assert.Equal(t, requestStart.Add(time.Millisecond), batch.eldest)
+
+	harvested := batch.Close()
+	assert.Equal(t, 1, len(harvested))
+	assert.Equal(t, testRequestId2, harvested[0].RequestId)
+}
+
+func TestMaxInvocationsEvictsEmptyFirst(t *testing.T) {
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot, MaxInvocations: 2})
+
+	batch.AddInvocation(testRequestId, requestStart)
+	batch.AddTelemetry(testRequestId, bytes.NewBufferString(testTelemetry).Bytes())
+	batch.AddInvocation(testRequestId2, requestStart.Add(time.Millisecond))
+
+	// The empty invocation goes first, even though it is newer, and nothing is counted as dropped
+	batch.AddInvocation(testRequestId3, requestStart.Add(2*time.Millisecond))
+	assert.Equal(t, 0, batch.Dropped())
+	assert.Equal(t, 2, len(batch.invocations))
+	assert.Nil(t, batch.AddTelemetry(testRequestId2, bytes.NewBufferString(testTelemetry).Bytes()))
+	assert.NotNil(t, batch.AddTelemetry(testRequestId, bytes.NewBufferString(moreTestTelemetry).Bytes()))
+	assert.Equal(t, requestStart, batch.eldest)
+
+	// Likewise for the next empty invocation; the one with telemetry stays
+	batch.AddInvocation("test_d", requestStart.Add(3*time.Millisecond))
+	assert.Equal(t, 0, batch.Dropped())
+	assert.Equal(t, 2, len(batch.invocations))
+	assert.Nil(t, batch.AddTelemetry(testRequestId3, bytes.NewBufferString(testTelemetry).Bytes()))
+}
+
+func TestRipeJitter(t *testing.T) {
+	batch := NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot})
+	assert.Equal(t, ripe*time.Millisecond, batch.currentRipe)
+
+	batch = NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot, HarvestJitterMillis: 200})
+	varied := false
+	for i := 0; i < 1000; i++ {
+		jittered := batch.jitteredRipeDuration()
+		assert.True(t, jittered >= ripe*time.Millisecond)
+		assert.True(t, jittered <= (ripe+200)*time.Millisecond)
+		varied = varied || jittered != ripe*time.Millisecond
+	}
+	assert.True(t, varied)
+
+	// Jitter is capped at half the ripe duration
+	batch = NewBatch(&config.Configuration{RipeMillis: ripe, RotMillis: rot, HarvestJitterMillis: 10 * ripe})
+	assert.Equal(t, ripe/2*time.Millisecond, batch.ripeJitter)
+}
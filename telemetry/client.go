@@ -3,12 +3,20 @@ package telemetry
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/newrelic/newrelic-lambda-extension/config"
 	"github.com/newrelic/newrelic-lambda-extension/lambda/logserver"
 
 	"github.com/newrelic/newrelic-lambda-extension/util"
@@ -20,88 +28,470 @@ const (
 	LogEndpointEU   string = "https://log-api.eu.newrelic.com/log/v1"
 	LogEndpointUS   string = "https://log-api.newrelic.com/log/v1"
 
+	TelemetryEndpointName string = "telemetry"
+	LogEndpointName       string = "logs"
+
 	retries int = 3
+
+	// maxLoggedResponseLen is how much of an error response body is logged
+	maxLoggedResponseLen = 1024
 )
 
 type Client struct {
-	httpClient        *http.Client
-	licenseKey        string
-	telemetryEndpoint string
-	logEndpoint       string
-	functionName      string
-	batch             *Batch
-	collectTraceID    bool
+	httpClient         *http.Client
+	licenseKey         string
+	telemetryEndpoint  string
+	logEndpoint        string
+	functionName       string
+	functionVersion    string
+	serviceName        string
+	batch              *Batch
+	collectTraceID     bool
+	flattenAttributes  bool
+	spillDir           string
+	deadLetterDir      string
+	timestampPrecision string
+	webhookURL         string
+	webhookClient      *http.Client
+	webhookTasks       *sync.WaitGroup
+	sortLogs           bool
+	collapseDuplicates bool
+	sanitizeControl    bool
+	maxLogsPerPayload  int
+	payloadEncoding    PayloadEncoding
+	maxPayloadLen      int
+	logStreamName      string
+	teeLogs            string
+	attributeAllowlist map[string]bool
+	contentTypes       map[string]string
+	capturedEnv        map[string]string
+	maxAttributes      int
+	retryBudget        *retryBudget
+	maxAttempts        map[string]int
+	prefixLogType      bool
+	stats              map[string]*EndpointStats
+	records            RecordCounts
+	environment        *environmentEvent
+	statsLock          *sync.Mutex
+}
+
+// EndpointStats holds the send counters for a single endpoint
+type EndpointStats struct {
+	Attempts    int
+	Successes   int
+	Failures    int
+	LastError   string
+	LastSuccess time.Time
+	// Splits counts the extra payloads made by splitting batches that were too large for one payload
+	Splits int
+	// BytesSent is the total size of the payloads sent successfully, as encoded
+	BytesSent int
+}
+
+// retryBudget bounds the total time spent on retries, across all endpoints, until it is reset. A zero limit is unbounded.
+// Each retry is cut off once the budget runs out, so the budget is never overspent by more than the time to give up.
+type retryBudget struct {
+	limit time.Duration
+	spent time.Duration
+	lock  sync.Mutex
+}
+
+// remaining returns the budget left for another retry, and whether a retry is allowed at all. An unbounded budget
+// has zero remaining, but always allows a retry.
+func (b *retryBudget) remaining() (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.limit <= 0 {
+		return 0, true
+	}
+	return b.limit - b.spent, b.spent < b.limit
+}
+
+// spend records time spent on a retry
+func (b *retryBudget) spend(d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.spent += d
+}
+
+// reset makes the whole budget available again
+func (b *retryBudget) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.spent = 0
+}
+
+// Stats is a point-in-time copy of the client's send counters, keyed by endpoint name
+type Stats struct {
+	Endpoints map[string]EndpointStats
+	Records   RecordCounts
+}
+
+// RecordCounts counts the records sent, by type. Agent payloads are counted once, as they enter the batch, and credited
+// as the payloads holding them are accepted. Telemetry sent other than from the batch isn't counted.
+type RecordCounts struct {
+	Events  int
+	Metrics int
+	// Traces counts span events, which make up distributed traces
+	Traces int
+	Logs   int
+}
+
+func (r *RecordCounts) add(other RecordCounts) {
+	r.Events += other.Events
+	r.Metrics += other.Metrics
+	r.Traces += other.Traces
+	r.Logs += other.Logs
 }
 
 // New creates a telemetry client with sensible defaults
-func New(functionName string, licenseKey string, telemetryEndpointOverride string, logEndpointOverride string, batch *Batch, collectTraceID bool) *Client {
+func New(conf *config.Configuration, functionName string, licenseKey string, batch *Batch) *Client {
 	httpClient := &http.Client{
-		Timeout: time.Second * 2,
+		Timeout:   time.Second * 2,
+		Transport: newTransport(conf),
+	}
+
+	return NewWithHTTPClient(httpClient, conf, functionName, licenseKey, batch)
+}
+
+// newTransport returns a copy of the default transport, adjusted for our configuration
+func newTransport(conf *config.Configuration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if conf.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto map disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if conf.ConnectTimeoutMillis > 0 {
+		dialer := &net.Dialer{
+			Timeout:   time.Duration(conf.ConnectTimeoutMillis) * time.Millisecond,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	if conf.TLSTimeoutMillis > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(conf.TLSTimeoutMillis) * time.Millisecond
+	}
+
+	if conf.HeaderTimeoutMillis > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(conf.HeaderTimeoutMillis) * time.Millisecond
+	}
+
+	return transport
+}
+
+// newPayloadEncoding returns the configured payload encoding, or the default if none is configured
+func newPayloadEncoding(conf *config.Configuration) PayloadEncoding {
+	encoding := DefaultPayloadEncoding
+	if conf.Compression != "" {
+		encoding = PayloadEncoding{ContentEncoding: conf.Compression, Level: conf.CompressionLevel}
+	}
+
+	encoding.IdentityFallback = conf.CompressionFallback
+	return encoding
+}
+
+// newMaxPayloadLen returns the configured payload size limit, if it's valid, or the default. The header allowance is
+// taken off the limit, for gateways that count headers towards it.
+func newMaxPayloadLen(conf *config.Configuration) int {
+	maxPayloadLen := maxCompressedPayloadLen
+	if conf.MaxPayloadBytes > maxCompressedPayloadLen {
+		util.Logf("Ignoring NEW_RELIC_MAX_PAYLOAD_BYTES of %d; it may not exceed %d\n", conf.MaxPayloadBytes, maxCompressedPayloadLen)
+	} else if conf.MaxPayloadBytes > 0 {
+		maxPayloadLen = int(conf.MaxPayloadBytes)
+	}
+
+	if int(conf.HeaderAllowanceBytes) >= maxPayloadLen {
+		util.Logf("Ignoring NEW_RELIC_HEADER_ALLOWANCE_BYTES of %d; it must be less than the payload size limit of %d\n", conf.HeaderAllowanceBytes, maxPayloadLen)
+		return maxPayloadLen
+	}
+
+	return maxPayloadLen - int(conf.HeaderAllowanceBytes)
+}
+
+// newMaxAttributes returns the configured limit on attributes per log record, if it's valid, or the default
+func newMaxAttributes(conf *config.Configuration) int {
+	if conf.MaxAttributes == 0 {
+		return maxAttributesPerRecord
+	}
+
+	if conf.MaxAttributes > maxAttributesPerRecord {
+		util.Logf("Ignoring NEW_RELIC_MAX_ATTRIBUTES of %d; it may not exceed %d\n", conf.MaxAttributes, maxAttributesPerRecord)
+		return maxAttributesPerRecord
+	}
+
+	return int(conf.MaxAttributes)
+}
+
+// newMaxAttempts returns how many times a payload is tried: the endpoint's own setting if there is one, then the global
+// setting, then the default
+func newMaxAttempts(endpointAttempts uint32, globalAttempts uint32) int {
+	if endpointAttempts > 0 {
+		return int(endpointAttempts)
+	}
+
+	if globalAttempts > 0 {
+		return int(globalAttempts)
 	}
 
-	return NewWithHTTPClient(httpClient, functionName, licenseKey, telemetryEndpointOverride, logEndpointOverride, batch, collectTraceID)
+	return retries
+}
+
+// capturedEnvironment returns the values of the named environment variables. Unset variables are left out.
+func capturedEnvironment(names []string) map[string]string {
+	ret := make(map[string]string, len(names))
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			ret[name] = value
+		}
+	}
+
+	return ret
 }
 
 // NewWithHTTPClient is just like New, but the HTTP client can be overridden
-func NewWithHTTPClient(httpClient *http.Client, functionName string, licenseKey string, telemetryEndpointOverride string, logEndpointOverride string, batch *Batch, collectTraceID bool) *Client {
-	telemetryEndpoint := getInfraEndpointURL(licenseKey, telemetryEndpointOverride)
-	logEndpoint := getLogEndpointURL(licenseKey, logEndpointOverride)
+func NewWithHTTPClient(httpClient *http.Client, conf *config.Configuration, functionName string, licenseKey string, batch *Batch) *Client {
+	telemetryEndpoint := getInfraEndpointURL(licenseKey, conf.Region, conf.TelemetryEndpoint)
+	logEndpoint := getLogEndpointURL(licenseKey, conf.Region, conf.LogEndpoint)
+	logStreamName := conf.LogStreamName
+	if logStreamName == "" {
+		logStreamName = util.Id
+	}
 	return &Client{
-		httpClient:        httpClient,
-		licenseKey:        licenseKey,
-		telemetryEndpoint: telemetryEndpoint,
-		logEndpoint:       logEndpoint,
-		functionName:      functionName,
-		batch:             batch,
-		collectTraceID:    collectTraceID,
+		httpClient:         httpClient,
+		licenseKey:         licenseKey,
+		telemetryEndpoint:  telemetryEndpoint,
+		logEndpoint:        logEndpoint,
+		functionName:       functionName,
+		batch:              batch,
+		collectTraceID:     conf.CollectTraceID,
+		flattenAttributes:  conf.FlattenAttributes,
+		spillDir:           conf.SpillDir,
+		deadLetterDir:      newDeadLetterDir(conf),
+		timestampPrecision: conf.TimestampPrecision,
+		webhookURL:         conf.WebhookURL,
+		webhookClient:      newWebhookClient(conf),
+		webhookTasks:       &sync.WaitGroup{},
+		functionVersion:    conf.FunctionVersion,
+		serviceName:        conf.ServiceName,
+		sortLogs:           conf.SortLogs,
+		collapseDuplicates: conf.CollapseDuplicates,
+		sanitizeControl:    conf.SanitizeControlChars,
+		maxLogsPerPayload:  int(conf.MaxLogsPerPayload),
+		payloadEncoding:    newPayloadEncoding(conf),
+		maxPayloadLen:      newMaxPayloadLen(conf),
+		logStreamName:      logStreamName,
+		teeLogs:            conf.TeeLogs,
+		attributeAllowlist: NewAttributeAllowlist(conf.AttributeAllowlist),
+		capturedEnv:        capturedEnvironment(conf.CaptureEnv),
+		maxAttributes:      newMaxAttributes(conf),
+		retryBudget:        &retryBudget{limit: time.Duration(conf.RetryBudgetMillis) * time.Millisecond},
+		prefixLogType:      conf.PrefixLogType,
+		environment:        newEnvironmentEvent(conf),
+		maxAttempts: map[string]int{
+			TelemetryEndpointName: newMaxAttempts(conf.TelemetryMaxAttempts, conf.MaxAttempts),
+			LogEndpointName:       newMaxAttempts(conf.LogMaxAttempts, conf.MaxAttempts),
+		},
+		contentTypes: map[string]string{
+			TelemetryEndpointName: conf.TelemetryContentType,
+			LogEndpointName:       conf.LogContentType,
+		},
+		stats: map[string]*EndpointStats{
+			TelemetryEndpointName: {},
+			LogEndpointName:       {},
+		},
+		statsLock: &sync.Mutex{},
 	}
 }
 
-// getInfraEndpointURL returns the Vortex endpoint for the provided license key
-func getInfraEndpointURL(licenseKey string, telemetryEndpointOverride string) string {
-	if telemetryEndpointOverride != "" {
-		return telemetryEndpointOverride
+// Stats returns a snapshot of the per-endpoint send counters. It is safe to call concurrently with sends.
+func (c *Client) Stats() Stats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	ret := Stats{Endpoints: make(map[string]EndpointStats, len(c.stats)), Records: c.records}
+	for name, s := range c.stats {
+		ret.Endpoints[name] = *s
 	}
+	return ret
+}
 
-	if strings.HasPrefix(licenseKey, "eu") {
-		return InfraEndpointEU
+// ResetRetryBudget makes the whole retry budget available again. It is called once per invocation, so that the time
+// spent retrying sends for an invocation is bounded.
+func (c *Client) ResetRetryBudget() {
+	c.retryBudget.reset()
+}
+
+// recordSend updates the counters for an endpoint after a payload of payloadLen bytes has been sent, or has failed to send
+func (c *Client) recordSend(endpointName string, attempts int, payloadLen int, sendErr error) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	s, ok := c.stats[endpointName]
+	if !ok {
+		s = &EndpointStats{}
+		c.stats[endpointName] = s
 	}
 
-	return InfraEndpointUS
+	s.Attempts += attempts
+	if sendErr != nil {
+		s.Failures++
+		s.LastError = sendErr.Error()
+	} else {
+		s.Successes++
+		s.LastSuccess = time.Now()
+		s.BytesSent += payloadLen
+	}
 }
 
-// getLogEndpointURL returns the Vortex endpoint for the provided license key
-func getLogEndpointURL(licenseKey string, logEndpointOverride string) string {
-	if logEndpointOverride != "" {
-		return logEndpointOverride
+// recordRecords counts records that were accepted
+func (c *Client) recordRecords(records RecordCounts) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	c.records.add(records)
+}
+
+// recordSplits counts the extra payloads made for an endpoint by splitting an oversized batch
+func (c *Client) recordSplits(endpointName string, splits int) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	s, ok := c.stats[endpointName]
+	if !ok {
+		s = &EndpointStats{}
+		c.stats[endpointName] = s
+	}
+
+	s.Splits += splits
+}
+
+// endpointURL chooses an endpoint. An explicit override takes precedence, then the configured region, and then the
+// region implied by the license key's prefix.
+func endpointURL(endpointName string, licenseKey string, region string, endpointOverride string, endpointUS string, endpointEU string) string {
+	if endpointOverride != "" {
+		util.Debugf("Using the %s endpoint override %s\n", endpointName, endpointOverride)
+		return endpointOverride
+	}
+
+	if region != "" {
+		util.Debugf("Using the %s endpoint for region %s\n", endpointName, region)
+		if region == config.RegionEU {
+			return endpointEU
+		}
+		return endpointUS
 	}
 
 	if strings.HasPrefix(licenseKey, "eu") {
-		return LogEndpointEU
+		util.Debugf("Using the %s endpoint for the license key's region, eu\n", endpointName)
+		return endpointEU
+	}
+
+	util.Debugf("Using the %s endpoint for the license key's region, us\n", endpointName)
+	return endpointUS
+}
+
+// logTypePrefix returns the prefix for a log line's Logs API type
+func logTypePrefix(line logserver.LogLine) string {
+	if line.Extension {
+		return "[extension] "
 	}
+	return "[function] "
+}
+
+// sanitizeResponseBody prepares an error response body for logging. Endpoints may echo the request, so the license key
+// is redacted, and long bodies are truncated.
+func sanitizeResponseBody(body string, licenseKey string) string {
+	if licenseKey != "" {
+		body = strings.ReplaceAll(body, licenseKey, "[REDACTED]")
+	}
+
+	if len(body) > maxLoggedResponseLen {
+		body = fmt.Sprintf("%s... (%d bytes truncated)", strings.ToValidUTF8(body[:maxLoggedResponseLen], ""), len(body)-maxLoggedResponseLen)
+	}
+
+	return body
+}
+
+// getInfraEndpointURL returns the Vortex endpoint for the provided license key
+func getInfraEndpointURL(licenseKey string, region string, telemetryEndpointOverride string) string {
+	return endpointURL(TelemetryEndpointName, licenseKey, region, telemetryEndpointOverride, InfraEndpointUS, InfraEndpointEU)
+}
 
-	return LogEndpointUS
+// getLogEndpointURL returns the Vortex endpoint for the provided license key
+func getLogEndpointURL(licenseKey string, region string, logEndpointOverride string) string {
+	return endpointURL(LogEndpointName, licenseKey, region, logEndpointOverride, LogEndpointUS, LogEndpointEU)
 }
 
+// SendTelemetry sends telemetry payloads to the telemetry endpoint. The records within them aren't counted; use
+// SendInvocations for telemetry from the batch.
 func (c *Client) SendTelemetry(ctx context.Context, invokedFunctionARN string, telemetry [][]byte) (error, int) {
 	start := time.Now()
 	logEvents := make([]LogsEvent, 0, len(telemetry))
 	for _, payload := range telemetry {
-		logEvent := LogsEventForBytes(payload)
-		logEvents = append(logEvents, logEvent)
+		// Infra ingest expects milliseconds, whatever the configured timestamp precision
+		logEvents = append(logEvents, LogsEventForBytes(payload))
 	}
 
-	compressedPayloads, err := CompressedPayloadsForLogEvents(logEvents, c.functionName, invokedFunctionARN)
-	if err != nil {
-		return err, 0
+	return c.sendLogsEvents(ctx, invokedFunctionARN, logEvents, start)
+}
+
+// SendInvocations sends the telemetry of harvested invocations to the telemetry endpoint. The records counted as the
+// telemetry entered the batch are credited for each payload that is accepted.
+func (c *Client) SendInvocations(ctx context.Context, invokedFunctionARN string, invocations []*Invocation) (error, int) {
+	start := time.Now()
+	logEvents := make([]LogsEvent, 0, 2*len(invocations))
+	for _, inv := range invocations {
+		for i, payload := range inv.Telemetry {
+			event := LogsEventForBytes(payload)
+			event.records = inv.telemetryRecords(i)
+			logEvents = append(logEvents, event)
+		}
 	}
 
-	var builder requestBuilder = func(buffer *bytes.Buffer) (*http.Request, error) {
-		return BuildVortexRequest(ctx, c.telemetryEndpoint, buffer, util.Name, c.licenseKey)
+	return c.sendLogsEvents(ctx, invokedFunctionARN, logEvents, start)
+}
+
+// sendLogsEvents builds payloads for the log events, and sends them to the telemetry endpoint
+func (c *Client) sendLogsEvents(ctx context.Context, invokedFunctionARN string, logEvents []LogsEvent, start time.Time) (error, int) {
+	payloads, compressErr := compressedPayloadsForLogEvents(logEvents, c.functionName, invokedFunctionARN, c.logStreamName, c.payloadEncoding, c.maxPayloadLen, 0)
+	if oversized, ok := compressErr.(*OversizedEventsError); ok {
+		// These will never fit, so there's no point in spilling them for another try
+		for _, event := range oversized.Events {
+			c.deadLetter(TelemetryEndpointName, []byte(event.Message), oversized.Error())
+		}
+	}
+	if compressErr != nil {
+		if len(payloads) == 0 {
+			return compressErr, 0
+		}
+		// Send what we can; the error is still reported to the caller
+		util.Logf("Some telemetry could not be prepared, and will not be sent: %v", compressErr)
+	}
+	if len(payloads) > 1 {
+		util.Debugf("Split %d log events into %d payloads to fit the payload size limit\n", len(logEvents), len(payloads))
+		c.recordSplits(TelemetryEndpointName, len(payloads)-1)
+	}
+
+	compressedPayloads := make([]*bytes.Buffer, 0, len(payloads))
+	for _, p := range payloads {
+		compressedPayloads = append(compressedPayloads, p.body)
 	}
 
 	transmitStart := time.Now()
-	successCount, sentBytes, err := c.sendPayloads(compressedPayloads, builder)
+	c.forwardToWebhook(ctx, TelemetryEndpointName, compressedPayloads)
+	successCount, sentBytes, accepted := c.sendPayloads(TelemetryEndpointName, compressedPayloads, c.telemetryRequestBuilder(ctx))
+	for i, ok := range accepted {
+		if ok {
+			c.recordRecords(payloads[i].records)
+		}
+	}
 	end := time.Now()
 	totalTime := end.Sub(start)
 	transmissionTime := end.Sub(transmitStart)
@@ -109,36 +499,137 @@ func (c *Client) SendTelemetry(ctx context.Context, invokedFunctionARN string, t
 		"Sent %d/%d New Relic payload batches with %d log events successfully in %.3fms (%dms to transmit %.1fkB).\n",
 		successCount,
 		len(compressedPayloads),
-		len(telemetry),
+		len(logEvents),
 		float64(totalTime.Microseconds())/1000.0,
 		transmissionTime.Milliseconds(),
 		float64(sentBytes)/1024.0,
 	)
 
-	return nil, successCount
+	return compressErr, successCount
+}
+
+// tee logs a function log payload, as sent, when tee mode is on
+func (c *Client) tee(logData []DetailedFunctionLog) {
+	if c.teeLogs == "" {
+		return
+	}
+
+	payload, err := json.Marshal(logData)
+	if err != nil {
+		util.Logln("Failed to tee function logs", err)
+		return
+	}
+
+	if c.teeLogs == config.DebugLogLevel {
+		util.Debugf("Function log payload: %s\n", payload)
+	} else {
+		util.Logf("Function log payload: %s\n", payload)
+	}
+}
+
+// convertTimestamp converts a Unix timestamp in milliseconds to the configured precision. It only applies to Log API
+// records.
+func (c *Client) convertTimestamp(millis int64) int64 {
+	if c.timestampPrecision == config.TimestampPrecisionSeconds {
+		return millis / 1000
+	}
+	return millis
 }
 
 type requestBuilder func(buffer *bytes.Buffer) (*http.Request, error)
 
-func (c *Client) sendPayloads(compressedPayloads []*bytes.Buffer, builder requestBuilder) (successCount int, sentBytes int, err error) {
+// telemetryRequestBuilder builds requests for the infra (Vortex) endpoint
+func (c *Client) telemetryRequestBuilder(ctx context.Context) requestBuilder {
+	return func(buffer *bytes.Buffer) (*http.Request, error) {
+		req, err := BuildVortexRequest(ctx, c.telemetryEndpoint, buffer, payloadContentEncoding(buffer.Bytes()), util.Name, c.licenseKey)
+		if err != nil {
+			return nil, err
+		}
+
+		c.overrideContentType(req, TelemetryEndpointName)
+		return req, err
+	}
+}
+
+// logRequestBuilder builds requests for the Log API endpoint
+func (c *Client) logRequestBuilder(ctx context.Context) requestBuilder {
+	return func(buffer *bytes.Buffer) (*http.Request, error) {
+		req, err := BuildVortexRequest(ctx, c.logEndpoint, buffer, payloadContentEncoding(buffer.Bytes()), util.Name, c.licenseKey)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Add("X-Event-Source", "logs")
+		c.overrideContentType(req, LogEndpointName)
+		return req, err
+	}
+}
+
+// overrideContentType replaces the default Content-Type, if one is configured for the endpoint
+func (c *Client) overrideContentType(req *http.Request, endpointName string) {
+	if contentType := c.contentTypes[endpointName]; contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+}
+
+// requestBuilderFor returns the request builder for the named endpoint, or nil if the name is unknown
+func (c *Client) requestBuilderFor(ctx context.Context, endpointName string) requestBuilder {
+	switch endpointName {
+	case TelemetryEndpointName:
+		return c.telemetryRequestBuilder(ctx)
+	case LogEndpointName:
+		return c.logRequestBuilder(ctx)
+	default:
+		return nil
+	}
+}
+
+// sendPayloads sends each payload, with retries, and reports which were accepted
+func (c *Client) sendPayloads(endpointName string, compressedPayloads []*bytes.Buffer, builder requestBuilder) (successCount int, sentBytes int, accepted []bool) {
 	successCount = 0
 	sentBytes = 0
-	for _, p := range compressedPayloads {
+	accepted = make([]bool, len(compressedPayloads))
+	for i, p := range compressedPayloads {
 		sentBytes += p.Len()
 		currentPayloadBytes := p.Bytes()
 
 		var res *http.Response
 		var err error
+		var buildFailed bool
 		var responseBody string
-		for attemptNum := 1; attemptNum <= retries; attemptNum++ {
+		attempts := 0
+		maxAttempts := c.maxAttempts[endpointName]
+		for attemptNum := 1; attemptNum <= maxAttempts; attemptNum++ {
+			var budget time.Duration
+			if attemptNum > 1 {
+				var ok bool
+				budget, ok = c.retryBudget.remaining()
+				if !ok {
+					util.Logf("Request failed. Retry budget exhausted after %v attempts.", attempts)
+					break
+				}
+			}
+
 			// Construct request for this try
 			var req *http.Request
 			req, err = builder(bytes.NewBuffer(currentPayloadBytes))
 			if err != nil {
+				buildFailed = true
 				break
 			}
+			if budget > 0 {
+				// A retry may not outlast the budget
+				budgetCtx, cancel := context.WithTimeout(req.Context(), budget)
+				defer cancel()
+				req = req.WithContext(budgetCtx)
+			}
 			//Make request, check for timeout
+			attempts++
+			attemptStart := time.Now()
 			res, err = c.httpClient.Do(req)
+			if attemptNum > 1 {
+				c.retryBudget.spend(time.Since(attemptStart))
+			}
 			if err == nil {
 				// Success. Process response and exit retry loop
 				defer util.Close(res.Body)
@@ -155,7 +646,7 @@ func (c *Client) sendPayloads(compressedPayloads []*bytes.Buffer, builder reques
 				case *url.Error:
 					// Retry on timeout
 					if err.(*url.Error).Timeout() {
-						if attemptNum < retries {
+						if attemptNum < maxAttempts {
 							util.Debugln("Retrying after timeout", err)
 						} else {
 							util.Logf("Request failed. Ran out of retries after %v attempts.", attemptNum)
@@ -175,29 +666,66 @@ func (c *Client) sendPayloads(compressedPayloads []*bytes.Buffer, builder reques
 		if err != nil {
 			util.Logf("Telemetry client error: %s", err)
 			sentBytes -= p.Len()
+			c.recordSend(endpointName, attempts, p.Len(), err)
+			if buildFailed {
+				// A request that can't be built won't be any better when replayed
+				c.deadLetter(endpointName, currentPayloadBytes, err.Error())
+			} else {
+				c.spill(endpointName, currentPayloadBytes)
+			}
 		} else if res.StatusCode >= 300 {
-			util.Logf("Telemetry client response: [%s] %s", res.Status, responseBody)
+			util.Logf("Telemetry client response: [%s] %s", res.Status, sanitizeResponseBody(responseBody, c.licenseKey))
+			c.recordSend(endpointName, attempts, p.Len(), fmt.Errorf("unexpected response status: %s", res.Status))
+			if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+				c.spill(endpointName, currentPayloadBytes)
+			} else {
+				c.deadLetter(endpointName, currentPayloadBytes, fmt.Sprintf("%s\n%s", res.Status, sanitizeResponseBody(responseBody, c.licenseKey)))
+			}
 		} else {
 			successCount += 1
+			accepted[i] = true
+			c.recordSend(endpointName, attempts, p.Len(), nil)
 		}
 	}
 
-	return successCount, sentBytes, nil
+	return successCount, sentBytes, accepted
 }
 
 func (c *Client) SendFunctionLogs(ctx context.Context, invokedFunctionARN string, lines []logserver.LogLine) error {
 	start := time.Now()
 
 	common := map[string]interface{}{
-		"plugin":    util.Id,
-		"faas.arn":  invokedFunctionARN,
-		"faas.name": c.functionName,
+		"plugin":               util.Id,
+		"extension.instanceId": util.InstanceId,
+		"faas.arn":             UnqualifiedARN(invokedFunctionARN),
+		"faas.name":            c.functionName,
+	}
+	// The invoked ARN carries the version or alias the function was invoked through, if any
+	if invokedFunctionARN != common["faas.arn"] {
+		common["faas.qualifiedArn"] = invokedFunctionARN
+	}
+	if c.functionVersion != "" {
+		common["faas.version"] = c.functionVersion
+	}
+	if c.serviceName != "" {
+		common["service.name"] = c.serviceName
+	}
+	if accountID := AccountIDFromARN(invokedFunctionARN); accountID != "" {
+		common["cloud.account.id"] = accountID
+	}
+	for name, value := range c.capturedEnv {
+		common[name] = value
 	}
 
 	logMessages := make([]FunctionLogMessage, 0, len(lines))
 	for _, l := range lines {
-		// Unix time in ms
-		ts := l.Time.UnixNano() / 1e6
+		if l.Extension && bytes.HasPrefix(l.Content, []byte(util.LogPrefix)) {
+			// Our own log lines come back through the Logs API along with those of other extensions. Sending them
+			// would log more lines, which would come back in turn.
+			continue
+		}
+		// Unix time in ms, or s if so configured
+		ts := c.convertTimestamp(l.Time.UnixNano() / 1e6)
 		var traceId string
 		if c.batch != nil && c.collectTraceID {
 			// There is a race condition here. Telemetry batch may be late, so the trace
@@ -205,31 +733,84 @@ func (c *Client) SendFunctionLogs(ctx context.Context, invokedFunctionARN string
 			// logs being sent. Not sure if worth the performance hit yet.
 			traceId = c.batch.RetrieveTraceID(l.RequestID)
 		}
-		logMessages = append(logMessages, NewFunctionLogMessage(ts, l.RequestID, traceId, string(l.Content)))
+		message := string(l.Content)
+		if c.sanitizeControl {
+			message = SanitizeControlChars(message)
+		}
+		if c.prefixLogType {
+			message = logTypePrefix(l) + message
+		}
+		logMessage := NewFunctionLogMessage(ts, l.RequestID, traceId, message)
+		if l.Extension {
+			// Marks the logs of extensions, which are forwarded along with function logs if so configured
+			logMessage.Attributes["extension.log"] = true
+		}
+		logMessages = append(logMessages, logMessage)
 		util.Debugf("Sending function logs for request %s", l.RequestID)
 	}
-	// The Log API expects an array
-	logData := []DetailedFunctionLog{NewDetailedFunctionLog(common, logMessages)}
+	if len(logMessages) == 0 {
+		return nil
+	}
+	if c.sortLogs {
+		// Log batches can arrive interleaved; order them for readability
+		sort.SliceStable(logMessages, func(i, j int) bool {
+			return logMessages[i].Timestamp < logMessages[j].Timestamp
+		})
+	}
 
-	// Since the Log API won't send us more than 1MB, we shouldn't have any issues with payload size.
-	compressedPayload, err := CompressedJsonPayload(logData)
-	if err != nil {
-		return err
+	if c.collapseDuplicates {
+		logMessages = CollapseDuplicates(logMessages)
 	}
-	compressedPayloads := []*bytes.Buffer{compressedPayload}
 
-	var builder requestBuilder = func(buffer *bytes.Buffer) (*http.Request, error) {
-		req, err := BuildVortexRequest(ctx, c.logEndpoint, buffer, util.Name, c.licenseKey)
-		if err != nil {
-			return nil, err
+	if c.flattenAttributes {
+		common = FlattenAttributes(common)
+		for i := range logMessages {
+			logMessages[i].Attributes = FlattenAttributes(logMessages[i].Attributes)
 		}
+	}
 
-		req.Header.Add("X-Event-Source", "logs")
-		return req, err
+	if c.attributeAllowlist != nil {
+		common = FilterAttributes(common, c.attributeAllowlist)
+		for i := range logMessages {
+			logMessages[i].Attributes = FilterAttributes(logMessages[i].Attributes, c.attributeAllowlist)
+		}
+	}
+
+	// Common attributes count towards every record's limit
+	common, droppedAttributes := LimitAttributes(common, c.maxAttributes)
+	for i := range logMessages {
+		var dropped int
+		logMessages[i].Attributes, dropped = LimitAttributes(logMessages[i].Attributes, c.maxAttributes-len(common))
+		droppedAttributes += dropped
+	}
+	if droppedAttributes > 0 {
+		util.Logf("Warning: dropped %d attributes from function logs to stay within %d attributes per record\n", droppedAttributes, c.maxAttributes)
+	}
+
+	// Since the Log API won't send us more than 1MB, we shouldn't have any issues with payload size. The number of
+	// log events per payload may still be capped.
+	chunks := ChunkFunctionLogs(logMessages, c.maxLogsPerPayload)
+	compressedPayloads := make([]*bytes.Buffer, 0, len(chunks))
+	for _, chunk := range chunks {
+		// The Log API expects an array
+		logData := []DetailedFunctionLog{NewDetailedFunctionLog(common, chunk)}
+		c.tee(logData)
+
+		compressedPayload, err := CompressedJsonPayload(logData, c.payloadEncoding)
+		if err != nil {
+			return err
+		}
+		compressedPayloads = append(compressedPayloads, compressedPayload)
 	}
 
 	transmitStart := time.Now()
-	successCount, sentBytes, err := c.sendPayloads(compressedPayloads, builder)
+	c.forwardToWebhook(ctx, LogEndpointName, compressedPayloads)
+	successCount, sentBytes, accepted := c.sendPayloads(LogEndpointName, compressedPayloads, c.logRequestBuilder(ctx))
+	for i, ok := range accepted {
+		if ok {
+			c.recordRecords(RecordCounts{Logs: len(chunks[i])})
+		}
+	}
 	end := time.Now()
 	totalTime := end.Sub(start)
 	transmissionTime := end.Sub(transmitStart)
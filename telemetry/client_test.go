@@ -1,15 +1,24 @@
 package telemetry
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/lambda/logserver"
 	"github.com/newrelic/newrelic-lambda-extension/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -42,7 +51,7 @@ func TestClientSend(t *testing.T) {
 
 	defer srv.Close()
 
-	client := NewWithHTTPClient(srv.Client(), "", "a mock license key", srv.URL, srv.URL, &Batch{}, false)
+	client := NewWithHTTPClient(srv.Client(), &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}, "", "a mock license key", &Batch{})
 
 	ctx := context.Background()
 	bytes := []byte("foobar")
@@ -51,7 +60,7 @@ func TestClientSend(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, successCount)
 
-	client = New("", "mock license key", srv.URL, srv.URL, &Batch{}, false)
+	client = New(&config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}, "", "mock license key", &Batch{})
 	assert.NotNil(t, client)
 }
 
@@ -93,7 +102,7 @@ func TestClientSendRetry(t *testing.T) {
 
 	httpClient := srv.Client()
 	httpClient.Timeout = 200 * time.Millisecond
-	client := NewWithHTTPClient(httpClient, "", "a mock license key", srv.URL, srv.URL, &Batch{}, false)
+	client := NewWithHTTPClient(httpClient, &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}, "", "a mock license key", &Batch{})
 
 	ctx := context.Background()
 	bytes := []byte("foobar")
@@ -115,7 +124,7 @@ func TestClientSendOutOfRetries(t *testing.T) {
 
 	httpClient := srv.Client()
 	httpClient.Timeout = 200 * time.Millisecond
-	client := NewWithHTTPClient(httpClient, "", "a mock license key", srv.URL, srv.URL, &Batch{}, false)
+	client := NewWithHTTPClient(httpClient, &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}, "", "a mock license key", &Batch{})
 
 	ctx := context.Background()
 	bytes := []byte("foobar")
@@ -126,12 +135,107 @@ func TestClientSendOutOfRetries(t *testing.T) {
 	assert.Equal(t, int32(retries), atomic.LoadInt32(&count))
 }
 
+func TestNewMaxAttempts(t *testing.T) {
+	assert.Equal(t, retries, newMaxAttempts(0, 0))
+	assert.Equal(t, 5, newMaxAttempts(0, 5))
+	assert.Equal(t, 1, newMaxAttempts(1, 5))
+}
+
+func TestClientMaxAttempts(t *testing.T) {
+	var telemetryCount, logCount int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logs" {
+			atomic.AddInt32(&logCount, 1)
+		} else {
+			atomic.AddInt32(&telemetryCount, 1)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}))
+
+	defer srv.Close()
+
+	httpClient := srv.Client()
+	httpClient.Timeout = 50 * time.Millisecond
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL + "/telemetry", LogEndpoint: srv.URL + "/logs", MaxAttempts: 2, LogMaxAttempts: 1}
+	client := NewWithHTTPClient(httpClient, conf, "", "a mock license key", &Batch{})
+
+	ctx := context.Background()
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	err, successCount := client.SendTelemetry(ctx, "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&telemetryCount))
+
+	assert.NoError(t, client.SendFunctionLogs(ctx, "", lines))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logCount))
+}
+
+func TestClientRetryBudget(t *testing.T) {
+	var count int32 = 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+
+	defer srv.Close()
+
+	httpClient := srv.Client()
+	httpClient.Timeout = 50 * time.Millisecond
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, RetryBudgetMillis: 75}
+	client := NewWithHTTPClient(httpClient, conf, "", "a mock license key", &Batch{})
+
+	ctx := context.Background()
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	// Two retries for telemetry use up the budget, so logs get no retries
+	err, successCount := client.SendTelemetry(ctx, "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+	assert.Equal(t, int32(retries), atomic.LoadInt32(&count))
+
+	assert.NoError(t, client.SendFunctionLogs(ctx, "", lines))
+	assert.Equal(t, int32(retries+1), atomic.LoadInt32(&count))
+
+	client.ResetRetryBudget()
+	assert.NoError(t, client.SendFunctionLogs(ctx, "", lines))
+	assert.Equal(t, int32(2*retries+1), atomic.LoadInt32(&count))
+}
+
+func TestClientRetryBudgetCutsOffRetries(t *testing.T) {
+	var count int32 = 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}))
+
+	defer srv.Close()
+
+	httpClient := srv.Client()
+	httpClient.Timeout = 200 * time.Millisecond
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, RetryBudgetMillis: 220}
+	client := NewWithHTTPClient(httpClient, conf, "", "a mock license key", &Batch{})
+
+	// The first attempt isn't budgeted, and the first retry leaves 20ms of budget, which cuts off the last retry
+	start := time.Now()
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	elapsed := time.Since(start)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+	assert.Equal(t, int32(retries), atomic.LoadInt32(&count))
+	assert.True(t, elapsed < 550*time.Millisecond, elapsed)
+}
+
 func TestClientUnreachableEndpoint(t *testing.T) {
 	httpClient := &http.Client{
 		Timeout: time.Millisecond * 1,
 	}
 
-	client := NewWithHTTPClient(httpClient, "", "a mock license key", "http://10.123.123.123:12345", "http://10.123.123.123:12345", &Batch{}, false)
+	client := NewWithHTTPClient(httpClient, &config.Configuration{TelemetryEndpoint: "http://10.123.123.123:12345", LogEndpoint: "http://10.123.123.123:12345"}, "", "a mock license key", &Batch{})
 
 	ctx := context.Background()
 	bytes := []byte("foobar")
@@ -142,13 +246,793 @@ func TestClientUnreachableEndpoint(t *testing.T) {
 }
 
 func TestGetInfraEndpointURL(t *testing.T) {
-	assert.Equal(t, "barbaz", getInfraEndpointURL("foobar", "barbaz"))
-	assert.Equal(t, InfraEndpointUS, getInfraEndpointURL("us license key", ""))
-	assert.Equal(t, InfraEndpointEU, getInfraEndpointURL("eu license key", ""))
+	assert.Equal(t, "barbaz", getInfraEndpointURL("foobar", "", "barbaz"))
+	assert.Equal(t, InfraEndpointUS, getInfraEndpointURL("us license key", "", ""))
+	assert.Equal(t, InfraEndpointEU, getInfraEndpointURL("eu license key", "", ""))
 }
 
 func TestGetLogEndpointURL(t *testing.T) {
-	assert.Equal(t, "barbaz", getLogEndpointURL("foobar", "barbaz"))
-	assert.Equal(t, LogEndpointUS, getLogEndpointURL("us mock license key", ""))
-	assert.Equal(t, LogEndpointEU, getLogEndpointURL("eu mock license key", ""))
+	assert.Equal(t, "barbaz", getLogEndpointURL("foobar", "", "barbaz"))
+	assert.Equal(t, LogEndpointUS, getLogEndpointURL("us mock license key", "", ""))
+	assert.Equal(t, LogEndpointEU, getLogEndpointURL("eu mock license key", "", ""))
+}
+
+func TestEndpointPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		licenseKey    string
+		region        string
+		override      string
+		expectedInfra string
+		expectedLog   string
+	}{
+		{"eu license key", config.RegionUS, "barbaz", "barbaz", "barbaz"},
+		{"us license key", config.RegionEU, "barbaz", "barbaz", "barbaz"},
+		{"eu license key", config.RegionUS, "", InfraEndpointUS, LogEndpointUS},
+		{"us license key", config.RegionEU, "", InfraEndpointEU, LogEndpointEU},
+		{"eu license key", "", "", InfraEndpointEU, LogEndpointEU},
+		{"us license key", "", "", InfraEndpointUS, LogEndpointUS},
+	} {
+		assert.Equal(t, tc.expectedInfra, getInfraEndpointURL(tc.licenseKey, tc.region, tc.override), tc)
+		assert.Equal(t, tc.expectedLog, getLogEndpointURL(tc.licenseKey, tc.region, tc.override), tc)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	var count int32 = 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		if atomic.AddInt32(&count, 1) > 2 {
+			w.WriteHeader(500)
+		} else {
+			w.WriteHeader(200)
+		}
+		w.Write([]byte(""))
+	}))
+
+	defer srv.Close()
+
+	client := NewWithHTTPClient(srv.Client(), &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}, "", "a mock license key", &Batch{})
+
+	stats := client.Stats()
+	assert.Equal(t, EndpointStats{}, stats.Endpoints[TelemetryEndpointName])
+	assert.Equal(t, EndpointStats{}, stats.Endpoints[LogEndpointName])
+
+	ctx := context.Background()
+	before := time.Now()
+	err, successCount := client.SendTelemetry(ctx, "arn:aws:lambda:us-east-1:1234:function:newrelic-example-go", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+
+	err = client.SendFunctionLogs(ctx, "arn:aws:lambda:us-east-1:1234:function:newrelic-example-go", []logserver.LogLine{{Time: time.Now(), RequestID: "abc", Content: []byte("log")}})
+	assert.NoError(t, err)
+
+	err, successCount = client.SendTelemetry(ctx, "arn:aws:lambda:us-east-1:1234:function:newrelic-example-go", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+
+	stats = client.Stats()
+
+	telemetryStats := stats.Endpoints[TelemetryEndpointName]
+	assert.Equal(t, 2, telemetryStats.Attempts)
+	assert.Equal(t, 1, telemetryStats.Successes)
+	assert.Equal(t, 1, telemetryStats.Failures)
+	assert.Contains(t, telemetryStats.LastError, "500")
+	assert.False(t, telemetryStats.LastSuccess.Before(before))
+
+	logStats := stats.Endpoints[LogEndpointName]
+	assert.Equal(t, 1, logStats.Attempts)
+	assert.Equal(t, 1, logStats.Successes)
+	assert.Equal(t, 0, logStats.Failures)
+	assert.Empty(t, logStats.LastError)
+	assert.False(t, logStats.LastSuccess.Before(before))
+}
+
+func TestClientTimestampPrecision(t *testing.T) {
+	logTime := time.Unix(1603821157, 123*int64(time.Millisecond))
+
+	for _, tc := range []struct {
+		precision       string
+		expectedLogTime int64
+	}{
+		{config.TimestampPrecisionMillis, 1603821157123},
+		{config.TimestampPrecisionSeconds, 1603821157},
+	} {
+		var logsEntry LogsEntry
+		var functionLogs []DetailedFunctionLog
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer util.Close(r.Body)
+
+			reqBytes, err := ioutil.ReadAll(r.Body)
+			assert.NoError(t, err)
+			reqBody, err := util.Uncompress(reqBytes)
+			assert.NoError(t, err)
+
+			if r.Header.Get("X-Event-Source") == "logs" {
+				assert.NoError(t, json.Unmarshal(reqBody, &functionLogs))
+			} else {
+				var reqData RequestData
+				assert.NoError(t, json.Unmarshal(reqBody, &reqData))
+				assert.NoError(t, json.Unmarshal([]byte(reqData.Entry), &logsEntry))
+			}
+
+			w.WriteHeader(200)
+		}))
+
+		conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, TimestampPrecision: tc.precision}
+		client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+		ctx := context.Background()
+		before := time.Now().Unix()
+		err, _ := client.SendTelemetry(ctx, "", [][]byte{[]byte("foobar")})
+		assert.NoError(t, err)
+		after := time.Now().Unix()
+
+		err = client.SendFunctionLogs(ctx, "", []logserver.LogLine{{Time: logTime, RequestID: "abc", Content: []byte("log")}})
+		assert.NoError(t, err)
+
+		srv.Close()
+
+		assert.Equal(t, tc.expectedLogTime, functionLogs[0].Logs[0].Timestamp)
+
+		// Telemetry sent to infra ingest is always in milliseconds
+		assert.Equal(t, 1, len(logsEntry.LogEvents))
+		assert.GreaterOrEqual(t, logsEntry.LogEvents[0].Timestamp, before*1000)
+		assert.LessOrEqual(t, logsEntry.LogEvents[0].Timestamp, (after+1)*1000)
+	}
+}
+
+// captureLogPayloads starts a Log API stand-in that accepts every request. The returned function logs hold the most
+// recently received payload.
+func captureLogPayloads(t *testing.T) (*httptest.Server, *[]DetailedFunctionLog) {
+	var functionLogs []DetailedFunctionLog
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		reqBody, err := util.Uncompress(reqBytes)
+		assert.NoError(t, err)
+		functionLogs = nil
+		assert.NoError(t, json.Unmarshal(reqBody, &functionLogs))
+
+		w.WriteHeader(200)
+	}))
+	return srv, &functionLogs
+}
+
+func TestClientSortLogs(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	start := time.Unix(1603821157, 0)
+	lines := []logserver.LogLine{
+		{Time: start.Add(2 * time.Second), RequestID: "abc", Content: []byte("third")},
+		{Time: start, RequestID: "abc", Content: []byte("first")},
+		{Time: start.Add(time.Second), RequestID: "abc", Content: []byte("second")},
+	}
+
+	for _, sortLogs := range []bool{false, true} {
+		conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, SortLogs: sortLogs}
+		client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+		assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+
+		var messages []string
+		for _, l := range (*functionLogs)[0].Logs {
+			messages = append(messages, l.Message)
+		}
+
+		if sortLogs {
+			assert.Equal(t, []string{"first", "second", "third"}, messages)
+		} else {
+			assert.Equal(t, []string{"third", "first", "second"}, messages)
+		}
+	}
+}
+
+func TestClientDisableHTTP2(t *testing.T) {
+	client := New(&config.Configuration{}, "", "mock license key", &Batch{})
+	transport := client.httpClient.Transport.(*http.Transport)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Nil(t, transport.TLSNextProto)
+
+	client = New(&config.Configuration{DisableHTTP2: true}, "", "mock license key", &Batch{})
+	transport = client.httpClient.Transport.(*http.Transport)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.NotNil(t, transport.TLSNextProto)
+	assert.Empty(t, transport.TLSNextProto)
+}
+
+func TestClientFunctionVersion(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.NotContains(t, (*functionLogs)[0].Common.Attributes, "faas.version")
+
+	conf.FunctionVersion = "7"
+	client = NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, "7", (*functionLogs)[0].Common.Attributes["faas.version"])
+}
+
+func TestClientAccountID(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "arn:aws:lambda:us-east-1:123456789012:function:my-function", lines))
+	assert.Equal(t, "123456789012", (*functionLogs)[0].Common.Attributes["cloud.account.id"])
+}
+
+func TestClientQualifiedARN(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "arn:aws:lambda:us-east-1:123456789012:function:my-function:live", lines))
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:my-function", (*functionLogs)[0].Common.Attributes["faas.arn"])
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:my-function:live", (*functionLogs)[0].Common.Attributes["faas.qualifiedArn"])
+
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "arn:aws:lambda:us-east-1:123456789012:function:my-function", lines))
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:my-function", (*functionLogs)[0].Common.Attributes["faas.arn"])
+	assert.NotContains(t, (*functionLogs)[0].Common.Attributes, "faas.qualifiedArn")
+}
+
+func TestClientInstanceId(t *testing.T) {
+	var instanceIds []interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		reqBody, err := util.Uncompress(reqBytes)
+		assert.NoError(t, err)
+
+		if r.URL.Path == "/logs" {
+			var functionLogs []DetailedFunctionLog
+			assert.NoError(t, json.Unmarshal(reqBody, &functionLogs))
+			instanceIds = append(instanceIds, functionLogs[0].Common.Attributes["extension.instanceId"])
+		} else {
+			// Infra ingest has a fixed request context, so the instance ID is left out of it
+			var reqData struct {
+				Context map[string]interface{} `json:"context"`
+			}
+			assert.NoError(t, json.Unmarshal(reqBody, &reqData))
+			assert.NotEmpty(t, reqData.Context)
+			assert.NotContains(t, reqData.Context, "extension.instanceId")
+		}
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL + "/telemetry", LogEndpoint: srv.URL + "/logs"}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	for i := 0; i < 2; i++ {
+		err, _ := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+		assert.NoError(t, err)
+		assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	}
+
+	assert.NotEmpty(t, util.InstanceId)
+	assert.Equal(t, []interface{}{util.InstanceId, util.InstanceId}, instanceIds)
+}
+
+func TestClientServiceName(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.NotContains(t, (*functionLogs)[0].Common.Attributes, "service.name")
+
+	conf.ServiceName = "checkout"
+	client = NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, "checkout", (*functionLogs)[0].Common.Attributes["service.name"])
+}
+
+func TestClientExtensionLogs(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	lines := []logserver.LogLine{
+		{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("function log line")},
+		{Time: time.Unix(1603821158, 0), RequestID: "abc", Content: []byte("extension log line"), Extension: true},
+		{Time: time.Unix(1603821159, 0), RequestID: "abc", Content: []byte(util.LogPrefix + "our own log line"), Extension: true},
+	}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+
+	logs := (*functionLogs)[0].Logs
+	assert.Len(t, logs, 2)
+	assert.Equal(t, "function log line", logs[0].Message)
+	assert.NotContains(t, logs[0].Attributes, "extension.log")
+	assert.Equal(t, "extension log line", logs[1].Message)
+	assert.Equal(t, true, logs[1].Attributes["extension.log"])
+}
+
+func TestClientExtensionLogsFeedback(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	log.SetPrefix(util.LogPrefix)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetPrefix("")
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, TeeLogs: config.DefaultLogLevel}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("extension log line"), Extension: true}}
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// What the send logged comes back through the Logs API as extension lines
+	var logged []logserver.LogLine
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		logged = append(logged, logserver.LogLine{Time: time.Unix(1603821158, 0), RequestID: "abc", Content: []byte(line), Extension: true})
+	}
+	assert.NotEmpty(t, logged)
+
+	output.Reset()
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", logged))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Empty(t, output.String())
+}
+
+func TestClientCaptureEnv(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	os.Setenv("ENVIRONMENT", "production")
+	os.Setenv("SERVICE", "checkout")
+	defer os.Unsetenv("ENVIRONMENT")
+	defer os.Unsetenv("SERVICE")
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, CaptureEnv: []string{"ENVIRONMENT", "SERVICE", "VERSION"}}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+
+	attributes := (*functionLogs)[0].Common.Attributes
+	assert.Equal(t, "production", attributes["ENVIRONMENT"])
+	assert.Equal(t, "checkout", attributes["SERVICE"])
+	assert.NotContains(t, attributes, "VERSION")
+}
+
+func TestClientMaxLogsPerPayload(t *testing.T) {
+	var payloadSizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		reqBody, err := util.Uncompress(reqBytes)
+		assert.NoError(t, err)
+		var functionLogs []DetailedFunctionLog
+		assert.NoError(t, json.Unmarshal(reqBody, &functionLogs))
+		payloadSizes = append(payloadSizes, len(functionLogs[0].Logs))
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	lines := make([]logserver.LogLine, 0, 250)
+	for i := 0; i < 250; i++ {
+		lines = append(lines, logserver.LogLine{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte(fmt.Sprintf("line %d", i))})
+	}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, []int{250}, payloadSizes)
+
+	payloadSizes = nil
+	conf.MaxLogsPerPayload = 100
+	client = NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, []int{100, 100, 50}, payloadSizes)
+}
+
+func TestClientCompression(t *testing.T) {
+	var contentEncoding string
+	var functionLogs []DetailedFunctionLog
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		contentEncoding = r.Header.Get("Content-Encoding")
+		reqBody, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		if contentEncoding == "gzip" {
+			reqBody, err = util.Uncompress(reqBody)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, json.Unmarshal(reqBody, &functionLogs))
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	for _, compression := range []string{config.CompressionGzip, config.CompressionIdentity} {
+		functionLogs = nil
+		conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, Compression: compression, CompressionLevel: gzip.BestSpeed}
+		client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+		assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+
+		if compression == config.CompressionGzip {
+			assert.Equal(t, "gzip", contentEncoding)
+		} else {
+			assert.Empty(t, contentEncoding)
+		}
+		assert.Equal(t, "log line", functionLogs[0].Logs[0].Message)
+	}
+}
+
+func TestNewMaxPayloadLen(t *testing.T) {
+	assert.Equal(t, maxCompressedPayloadLen, newMaxPayloadLen(&config.Configuration{}))
+	assert.Equal(t, 4096, newMaxPayloadLen(&config.Configuration{MaxPayloadBytes: 4096}))
+	assert.Equal(t, maxCompressedPayloadLen, newMaxPayloadLen(&config.Configuration{MaxPayloadBytes: 2 * maxCompressedPayloadLen}))
+}
+
+func TestNewMaxPayloadLenHeaderAllowance(t *testing.T) {
+	assert.Equal(t, maxCompressedPayloadLen-8192, newMaxPayloadLen(&config.Configuration{HeaderAllowanceBytes: 8192}))
+	assert.Equal(t, 4096-1024, newMaxPayloadLen(&config.Configuration{MaxPayloadBytes: 4096, HeaderAllowanceBytes: 1024}))
+	assert.Equal(t, 4096, newMaxPayloadLen(&config.Configuration{MaxPayloadBytes: 4096, HeaderAllowanceBytes: 4096}))
+}
+
+func TestNewMaxAttributes(t *testing.T) {
+	assert.Equal(t, maxAttributesPerRecord, newMaxAttributes(&config.Configuration{}))
+	assert.Equal(t, 100, newMaxAttributes(&config.Configuration{MaxAttributes: 100}))
+	assert.Equal(t, maxAttributesPerRecord, newMaxAttributes(&config.Configuration{MaxAttributes: 1000}))
+}
+
+func TestClientMaxAttributes(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, MaxAttributes: 6}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "arn:aws:lambda:us-east-1:123456789012:function:my-function", lines))
+
+	common := (*functionLogs)[0].Common.Attributes
+	assert.Len(t, common, 5)
+	for _, attribute := range mandatoryAttributes {
+		assert.Contains(t, common, attribute)
+	}
+	assert.Contains(t, common, "cloud.account.id")
+
+	attributes := (*functionLogs)[0].Logs[0].Attributes
+	assert.Len(t, attributes, 1)
+	assert.Contains(t, attributes, "aws")
+}
+
+func TestClientLogStreamName(t *testing.T) {
+	var reqData RequestData
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		reqBody, err := util.Uncompress(reqBytes)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(reqBody, &reqData))
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	err, _ := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, "newrelic-lambda-extension:"+util.Version, reqData.Context.LogStreamName)
+
+	conf.LogStreamName = "custom-stream"
+	client = NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	err, _ = client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, "custom-stream", reqData.Context.LogStreamName)
+}
+
+func TestClientTransportTimeouts(t *testing.T) {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+
+	transport := newTransport(&config.Configuration{})
+	assert.Equal(t, defaultTransport.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.Equal(t, defaultTransport.ResponseHeaderTimeout, transport.ResponseHeaderTimeout)
+
+	transport = newTransport(&config.Configuration{ConnectTimeoutMillis: 1500, TLSTimeoutMillis: 500, HeaderTimeoutMillis: 750})
+	assert.NotNil(t, transport.DialContext)
+	assert.Equal(t, 500*time.Millisecond, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 750*time.Millisecond, transport.ResponseHeaderTimeout)
+
+	// The replacement dialer still connects
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer util.Close(listener)
+	conn, err := transport.DialContext(context.Background(), "tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	util.Close(conn)
+}
+
+func TestClientTeeLogs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("teed log line")}}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.NotContains(t, output.String(), "teed log line")
+
+	conf.TeeLogs = config.DefaultLogLevel
+	client = NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Contains(t, output.String(), "Function log payload: ")
+	assert.Contains(t, output.String(), `"message":"teed log line"`)
+}
+
+func TestClientCompressionFallback(t *testing.T) {
+	defer func() {
+		compress = util.CompressLevel
+	}()
+	compress = func(b []byte, level int) (*bytes.Buffer, error) {
+		return nil, fmt.Errorf("compression failed")
+	}
+
+	var requestCount int
+	var contentEncoding string
+	var functionLogs []DetailedFunctionLog
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		requestCount++
+		contentEncoding = r.Header.Get("Content-Encoding")
+		reqBody, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(reqBody, &functionLogs))
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+
+	// Without the fallback, the logs can't be sent
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.Error(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, 0, requestCount)
+
+	conf.CompressionFallback = true
+	client = NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, 1, requestCount)
+	assert.Empty(t, contentEncoding)
+	assert.Equal(t, "log line", functionLogs[0].Logs[0].Message)
+}
+
+func TestClientContentType(t *testing.T) {
+	contentTypes := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		contentTypes[r.URL.Path] = r.Header.Get("Content-Type")
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+	send := func(conf *config.Configuration) {
+		client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+		err, _ := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+		assert.NoError(t, err)
+		assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	}
+
+	send(&config.Configuration{TelemetryEndpoint: srv.URL + "/telemetry", LogEndpoint: srv.URL + "/logs"})
+	assert.Equal(t, "application/json", contentTypes["/telemetry"])
+	assert.Equal(t, "application/json", contentTypes["/logs"])
+
+	send(&config.Configuration{
+		TelemetryEndpoint:    srv.URL + "/telemetry",
+		LogEndpoint:          srv.URL + "/logs",
+		TelemetryContentType: "application/vnd.example+json",
+		LogContentType:       "application/json; charset=utf-8",
+	})
+	assert.Equal(t, "application/vnd.example+json", contentTypes["/telemetry"])
+	assert.Equal(t, "application/json; charset=utf-8", contentTypes["/logs"])
+}
+
+func TestClientSplitStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, MaxPayloadBytes: 600, Compression: config.CompressionIdentity}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+	assert.Equal(t, 0, client.Stats().Endpoints[TelemetryEndpointName].Splits)
+
+	telemetry := [][]byte{[]byte(strings.Repeat("a", 200)), []byte(strings.Repeat("b", 200)), []byte(strings.Repeat("c", 200))}
+	err, successCount = client.SendTelemetry(context.Background(), "", telemetry)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, successCount)
+	assert.Equal(t, 2, client.Stats().Endpoints[TelemetryEndpointName].Splits)
+	assert.Equal(t, 0, client.Stats().Endpoints[LogEndpointName].Splits)
+}
+
+func TestClientSplitHeaderAllowance(t *testing.T) {
+	var payloadSizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		payloadSizes = append(payloadSizes, len(reqBytes))
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	telemetry := [][]byte{[]byte(strings.Repeat("a", 200)), []byte(strings.Repeat("b", 200))}
+
+	// Without an allowance the events fit one payload; with it, the effective limit is lower, so they're split
+	for _, tc := range []struct {
+		allowance        uint32
+		expectedPayloads int
+	}{
+		{0, 1},
+		{200, 2},
+	} {
+		payloadSizes = nil
+		conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, MaxPayloadBytes: 1000, HeaderAllowanceBytes: tc.allowance, Compression: config.CompressionIdentity}
+		client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+		err, successCount := client.SendTelemetry(context.Background(), "", telemetry)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedPayloads, successCount)
+		for _, size := range payloadSizes {
+			assert.LessOrEqual(t, size, 1000-int(tc.allowance))
+		}
+	}
+}
+
+func TestSanitizeResponseBody(t *testing.T) {
+	licenseKey := "0123456789abcdef0123456789abcdef0123NRAL"
+
+	assert.Equal(t, "bad request", sanitizeResponseBody("bad request", licenseKey))
+	assert.Equal(t, `{"error": "invalid key", "Api-Key": "[REDACTED]"}`, sanitizeResponseBody(`{"error": "invalid key", "Api-Key": "`+licenseKey+`"}`, licenseKey))
+	assert.Equal(t, "no key configured", sanitizeResponseBody("no key configured", ""))
+
+	long := "Api-Key: " + licenseKey + " " + strings.Repeat("x", 2*maxLoggedResponseLen)
+	sanitized := sanitizeResponseBody(long, licenseKey)
+	assert.NotContains(t, sanitized, licenseKey)
+	assert.True(t, strings.HasPrefix(sanitized, "Api-Key: [REDACTED] xxx"))
+	redactedLen := len("Api-Key: [REDACTED] ") + 2*maxLoggedResponseLen
+	assert.True(t, strings.HasSuffix(sanitized, fmt.Sprintf("... (%d bytes truncated)", redactedLen-maxLoggedResponseLen)))
+}
+
+func TestClientErrorResponseLogging(t *testing.T) {
+	licenseKey := "0123456789abcdef0123456789abcdef0123NRAL"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("rejected Api-Key " + r.Header.Get("X-License-Key") + strings.Repeat(" padding", 500)))
+	}))
+	defer srv.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	client := NewWithHTTPClient(srv.Client(), &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}, "", licenseKey, &Batch{})
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+
+	assert.Contains(t, logged.String(), "rejected Api-Key [REDACTED]")
+	assert.Contains(t, logged.String(), "bytes truncated")
+	assert.NotContains(t, logged.String(), licenseKey)
+}
+
+func TestClientBytesSentStats(t *testing.T) {
+	var telemetryBytes, logBytes int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		if r.URL.Path == "/logs" {
+			logBytes += len(reqBytes)
+		} else {
+			telemetryBytes += len(reqBytes)
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL + "/telemetry", LogEndpoint: srv.URL + "/logs"}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	lines := []logserver.LogLine{{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("log line")}}
+	for i := 0; i < 2; i++ {
+		err, _ := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+
+	stats := client.Stats()
+	assert.NotZero(t, telemetryBytes)
+	assert.NotZero(t, logBytes)
+	assert.Equal(t, telemetryBytes, stats.Endpoints[TelemetryEndpointName].BytesSent)
+	assert.Equal(t, logBytes, stats.Endpoints[LogEndpointName].BytesSent)
+}
+
+func TestClientPrefixLogType(t *testing.T) {
+	srv, functionLogs := captureLogPayloads(t)
+	defer srv.Close()
+
+	lines := []logserver.LogLine{
+		{Time: time.Unix(1603821157, 0), RequestID: "abc", Content: []byte("function log line")},
+		{Time: time.Unix(1603821158, 0), RequestID: "abc", Content: []byte("extension log line"), Extension: true},
+	}
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, "function log line", (*functionLogs)[0].Logs[0].Message)
+	assert.Equal(t, "extension log line", (*functionLogs)[0].Logs[1].Message)
+
+	conf.PrefixLogType = true
+	client = NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	assert.NoError(t, client.SendFunctionLogs(context.Background(), "", lines))
+	assert.Equal(t, "[function] function log line", (*functionLogs)[0].Logs[0].Message)
+	assert.Equal(t, "[extension] extension log line", (*functionLogs)[0].Logs[1].Message)
 }
@@ -0,0 +1,61 @@
+package telemetry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+)
+
+const (
+	// maxDeadLetterBytes caps the total size of the dead-letter payloads. Once full, rejected payloads are dropped as
+	// they would be without a dead-letter directory.
+	maxDeadLetterBytes = 5 * 1024 * 1024
+
+	// Dead-letter files have their own suffixes, so that they are never mistaken for spill files
+	deadLetterFileSuffix  = ".rejected"
+	deadLetterErrorSuffix = ".error"
+)
+
+// newDeadLetterDir returns the configured dead-letter directory, warning if it is also the spill directory
+func newDeadLetterDir(conf *config.Configuration) string {
+	if conf.DeadLetterDir != "" && filepath.Clean(conf.DeadLetterDir) == filepath.Clean(conf.SpillDir) {
+		util.Logf("NEW_RELIC_DEAD_LETTER_DIR should not be the same as NEW_RELIC_SPILL_DIR (%s)\n", conf.SpillDir)
+	}
+	return conf.DeadLetterDir
+}
+
+// deadLetter writes a payload that New Relic rejected, and the reason, to the dead-letter directory, if one is
+// configured, so that it can be inspected. Unlike spilled payloads, these are never resent. The dead-letter directory
+// must not be the spill directory: the suffixes keep spilled payloads and rejected ones apart, but they would share
+// one size cap.
+func (c *Client) deadLetter(endpointName string, payload []byte, reason string) {
+	if c.deadLetterDir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(c.deadLetterDir, 0700); err != nil {
+		util.Logf("Unable to create dead-letter directory %s: %v", c.deadLetterDir, err)
+		return
+	}
+
+	if dirSize(c.deadLetterDir, deadLetterFileSuffix)+dirSize(c.deadLetterDir, deadLetterErrorSuffix)+int64(len(payload)) > maxDeadLetterBytes {
+		util.Logf("Dead-letter directory %s is full, dropping %d byte %s payload", c.deadLetterDir, len(payload), endpointName)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%d-%s", endpointName, time.Now().UnixNano(), util.UUID())
+	if err := ioutil.WriteFile(filepath.Join(c.deadLetterDir, name+deadLetterFileSuffix), payload, 0600); err != nil {
+		util.Logf("Unable to write dead-letter %s payload: %v", endpointName, err)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.deadLetterDir, name+deadLetterErrorSuffix), []byte(reason), 0600); err != nil {
+		util.Logf("Unable to write dead-letter %s error: %v", endpointName, err)
+	}
+
+	util.Logf("Wrote rejected %d byte %s payload to dead-letter file %s", len(payload), endpointName, name)
+}
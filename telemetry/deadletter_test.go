@@ -0,0 +1,148 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterOnRejection(t *testing.T) {
+	deadLetterDir, err := ioutil.TempDir("", "dead-letter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(deadLetterDir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("malformed payload"))
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, DeadLetterDir: deadLetterDir, Compression: config.CompressionIdentity}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+
+	files, err := ioutil.ReadDir(deadLetterDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+
+	for _, f := range files {
+		assert.True(t, strings.HasPrefix(f.Name(), TelemetryEndpointName+"-"), f.Name())
+
+		contents, err := ioutil.ReadFile(filepath.Join(deadLetterDir, f.Name()))
+		assert.NoError(t, err)
+		if strings.HasSuffix(f.Name(), deadLetterErrorSuffix) {
+			assert.Contains(t, string(contents), "400 Bad Request")
+			assert.Contains(t, string(contents), "malformed payload")
+		} else {
+			assert.True(t, strings.HasSuffix(f.Name(), deadLetterFileSuffix), f.Name())
+			assert.Contains(t, string(contents), "foobar")
+		}
+	}
+}
+
+func TestDeadLetterSkippedForRetryableErrors(t *testing.T) {
+	deadLetterDir, err := ioutil.TempDir("", "dead-letter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(deadLetterDir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, DeadLetterDir: deadLetterDir}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	err, _ = client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+
+	files, err := ioutil.ReadDir(deadLetterDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDeadLetterNotResent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(400)
+	}))
+	defer srv.Close()
+
+	// Even when the directories are shared, spill replay leaves rejected payloads alone
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, SpillDir: dir, DeadLetterDir: dir}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	err, _ = client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	assert.Equal(t, 0, client.SendSpilled(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+func TestDeadLetterOversizedAgentPayload(t *testing.T) {
+	deadLetterDir, err := ioutil.TempDir("", "dead-letter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(deadLetterDir)
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, DeadLetterDir: deadLetterDir}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	client.maxPayloadLen = 1024
+
+	raw := make([]byte, 4*client.maxPayloadLen)
+	_, err = rand.Read(raw)
+	assert.NoError(t, err)
+	payload, err := encodePayload(map[string]interface{}{"data": map[string]interface{}{"padding": raw}})
+	assert.NoError(t, err)
+
+	// The platform log is sent, while the agent payload, which can't fit, is dead-lettered as is
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{payload, []byte("REPORT RequestId: abc")})
+	assert.Error(t, err)
+	assert.Equal(t, 1, successCount)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	files, err := ioutil.ReadDir(deadLetterDir)
+	assert.NoError(t, err)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), deadLetterFileSuffix) {
+			contents, err := ioutil.ReadFile(filepath.Join(deadLetterDir, f.Name()))
+			assert.NoError(t, err)
+			assert.Equal(t, payload, contents)
+		}
+	}
+	assert.Equal(t, 2, len(files))
+}
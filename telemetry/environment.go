@@ -0,0 +1,54 @@
+package telemetry
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+)
+
+const environmentEventType = "LambdaEnvironment"
+
+// environmentEvent is the LambdaEnvironment custom event, which describes the sandbox for fleet inventory. It is sent
+// at most once per sandbox.
+type environmentEvent struct {
+	attributes map[string]interface{}
+	once       *sync.Once
+}
+
+// newEnvironmentEvent returns the environment event, if it is enabled with NEW_RELIC_ENVIRONMENT_EVENT
+func newEnvironmentEvent(conf *config.Configuration) *environmentEvent {
+	if !conf.EnvironmentEvent {
+		return nil
+	}
+
+	return &environmentEvent{
+		attributes: map[string]interface{}{
+			"plugin":               util.Id,
+			"extension.instanceId": util.InstanceId,
+			"aws.region":           os.Getenv("AWS_REGION"),
+			"aws.lambda.runtime":   os.Getenv("AWS_EXECUTION_ENV"),
+			"aws.lambda.handler":   os.Getenv("_HANDLER"),
+			"aws.lambda.memoryMb":  os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"),
+			"extension.config":     conf.Redacted(),
+		},
+		once: &sync.Once{},
+	}
+}
+
+// SendEnvironment sends the LambdaEnvironment event, if it is enabled and hasn't been sent yet. Only the first call
+// sends, whether or not the event is accepted, so that a failure doesn't cost every invocation another request.
+func (c *Client) SendEnvironment(ctx context.Context, invokedFunctionARN string) {
+	if c.environment == nil {
+		return
+	}
+
+	c.environment.once.Do(func() {
+		err := c.sendCustomEvent(ctx, invokedFunctionARN, environmentEventType, c.environment.attributes)
+		if err != nil {
+			util.Logln("Failed to send environment event", err)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientSendEnvironment(t *testing.T) {
+	for name, value := range map[string]string{
+		"AWS_REGION":                      "us-west-2",
+		"AWS_EXECUTION_ENV":               "AWS_Lambda_nodejs14.x",
+		"_HANDLER":                        "index.handler",
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": "512",
+	} {
+		_ = os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	var messages []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		reqBody, err := util.Uncompress(reqBytes)
+		assert.NoError(t, err)
+
+		var reqData RequestData
+		assert.NoError(t, json.Unmarshal(reqBody, &reqData))
+		var logsEntry LogsEntry
+		assert.NoError(t, json.Unmarshal([]byte(reqData.Entry), &logsEntry))
+		messages = append(messages, logsEntry.LogEvents[0].Message)
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	arn := "arn:aws:lambda:us-west-2:123456789012:function:my-function"
+
+	// Disabled by default
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, LicenseKey: "secret-license-key"}
+	NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{}).SendEnvironment(ctx, arn)
+	assert.Empty(t, messages)
+
+	conf.EnvironmentEvent = true
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+	client.SendEnvironment(ctx, arn)
+	client.SendEnvironment(ctx, arn)
+	assert.Len(t, messages, 1)
+
+	decoded, err := base64.StdEncoding.DecodeString(messages[0])
+	assert.NoError(t, err)
+	segments, err := parsePayload(decoded)
+	assert.NoError(t, err)
+
+	var customEvents []json.RawMessage
+	assert.NoError(t, json.Unmarshal(segments["data"]["custom_event_data"], &customEvents))
+	var events [][]map[string]interface{}
+	assert.NoError(t, json.Unmarshal(customEvents[2], &events))
+	assert.Len(t, events, 1)
+
+	assert.Equal(t, environmentEventType, events[0][0]["type"])
+	attributes := events[0][1]
+	assert.Equal(t, "us-west-2", attributes["aws.region"])
+	assert.Equal(t, "AWS_Lambda_nodejs14.x", attributes["aws.lambda.runtime"])
+	assert.Equal(t, "index.handler", attributes["aws.lambda.handler"])
+	assert.Equal(t, "512", attributes["aws.lambda.memoryMb"])
+	assert.Equal(t, util.InstanceId, attributes["extension.instanceId"])
+	assert.Contains(t, attributes["extension.config"], "EnvironmentEvent:true")
+	assert.NotContains(t, attributes["extension.config"], "secret-license-key")
+}
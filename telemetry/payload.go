@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/newrelic/newrelic-lambda-extension/util"
 )
 
 type uncompressedData map[string]map[string]json.RawMessage
@@ -37,6 +39,27 @@ func parsePayload(data []byte) (uncompressedData uncompressedData, err error) {
 	return
 }
 
+// encodePayload is the inverse of parsePayload. It wraps the data in an agent payload, encoded as the agent writes it to
+// the telemetry pipe.
+func encodePayload(data interface{}) ([]byte, error) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := util.Compress(dataJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal([]interface{}{1, "NR_LAMBDA_MONITORING", base64.StdEncoding.EncodeToString(compressed.Bytes())})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(payload)), nil
+}
+
 func decodeUncompress(input string) ([]byte, error) {
 	decoded, err := base64.StdEncoding.DecodeString(input)
 	if err != nil {
@@ -56,6 +79,56 @@ func decodeUncompress(input string) ([]byte, error) {
 	return out.Bytes(), nil
 }
 
+// isAgentPayload is true when data is a base64 encoded agent payload, rather than plain text
+func isAgentPayload(data []byte) bool {
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	return err == nil && bytes.Contains(decoded, []byte("NR_LAMBDA_MONITORING"))
+}
+
+// countTelemetry counts the events, metrics and span events within an agent payload. Anything else, such as a platform
+// log line, counts for nothing.
+func countTelemetry(data []byte) RecordCounts {
+	var ret RecordCounts
+
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil || !bytes.Contains(decoded, []byte("NR_LAMBDA_MONITORING")) {
+		return ret
+	}
+
+	segments, err := parsePayload(decoded)
+	if err != nil {
+		return ret
+	}
+
+	dataSegment := segments["data"]
+	for _, name := range []string{"analytic_event_data", "custom_event_data", "error_event_data"} {
+		ret.Events += countPayloadItems(dataSegment[name], 2)
+	}
+	ret.Metrics = countPayloadItems(dataSegment["metric_data"], 3)
+	ret.Traces = countPayloadItems(dataSegment["span_event_data"], 2)
+
+	return ret
+}
+
+// countPayloadItems counts the items of a data segment, such as metric_data, which are held in an array at the given
+// index of the segment
+func countPayloadItems(segment json.RawMessage, index int) int {
+	if segment == nil {
+		return 0
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(segment, &parts); err != nil || len(parts) <= index {
+		return 0
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(parts[index], &items); err != nil {
+		return 0
+	}
+	return len(items)
+}
+
 // ExtractTraceID extracts the trace ID within a payload, if present
 func ExtractTraceID(data []byte) (string, error) {
 	decoded, err := base64.StdEncoding.DecodeString(string(data))
@@ -87,3 +87,10 @@ func TestExtractTraceIDInvalid(t *testing.T) {
 	assert.Error(t, err)
 	assert.Empty(t, traceId)
 }
+
+func TestCountTelemetry(t *testing.T) {
+	assert.Equal(t, RecordCounts{Events: 2, Metrics: 3, Traces: 4}, countTelemetry(agentPayload(t, 2, 3, 4)))
+	assert.Equal(t, RecordCounts{}, countTelemetry(agentPayload(t, 0, 0, 0)))
+	assert.Equal(t, RecordCounts{}, countTelemetry([]byte("REPORT RequestId: abc")))
+	assert.Equal(t, RecordCounts{}, countTelemetry([]byte(base64.StdEncoding.EncodeToString([]byte("[foobar]")))))
+}
@@ -2,18 +2,69 @@ package telemetry
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"unicode"
 
+	"github.com/newrelic/newrelic-lambda-extension/config"
 	"github.com/newrelic/newrelic-lambda-extension/util"
 )
 
 const (
+	// maxCompressedPayloadLen is the default, and largest allowed, limit on the size of a single payload
 	maxCompressedPayloadLen = 1000 * 1024
+	// maxSplitDepth bounds how many times a batch of log events may be split, or an event truncated, to fit a payload
+	maxSplitDepth = 32
+	// maxAttributesPerRecord is the default, and largest allowed, number of attributes on a single log record
+	maxAttributesPerRecord = 254
 )
 
+// compress is the compression function for payloads; tests may override it
+var compress = util.CompressLevel
+
+// PayloadEncoding is how request bodies are encoded. ContentEncoding is config.CompressionGzip or
+// config.CompressionIdentity, and Level is the gzip compression level. With IdentityFallback, a body that fails to
+// compress is sent uncompressed rather than dropped.
+type PayloadEncoding struct {
+	ContentEncoding  string
+	Level            int
+	IdentityFallback bool
+}
+
+// DefaultPayloadEncoding gzips at the default compression level
+var DefaultPayloadEncoding = PayloadEncoding{ContentEncoding: config.CompressionGzip, Level: gzip.DefaultCompression}
+
+// encode encodes a request body
+func (e PayloadEncoding) encode(b []byte) (*bytes.Buffer, error) {
+	if e.ContentEncoding == config.CompressionIdentity {
+		return bytes.NewBuffer(b), nil
+	}
+
+	compressed, err := compress(b, e.Level)
+	if err != nil && e.IdentityFallback {
+		util.Logf("Warning: compression failed, sending uncompressed: %v\n", err)
+		return bytes.NewBuffer(b), nil
+	}
+
+	return compressed, err
+}
+
+// payloadContentEncoding returns the Content-Encoding that matches an encoded payload. Since a payload that fails to
+// compress may be sent as is, this looks at the payload itself, rather than at the configured encoding.
+func payloadContentEncoding(payload []byte) string {
+	// Every gzip stream starts with these magic bytes; JSON never does
+	if len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b {
+		return config.CompressionGzip
+	}
+
+	return config.CompressionIdentity
+}
+
 // DetailedFunctionLog is the Logs API payload
 type DetailedFunctionLog struct {
 	Common CommonLogAttrs       `json:"common"`
@@ -44,6 +95,158 @@ func NewFunctionLogMessage(timestamp int64, requestId, traceId, message string)
 	}
 }
 
+// mandatoryAttributes are always kept by FilterAttributes; New Relic needs them to associate logs with the function
+var mandatoryAttributes = []string{"plugin", "extension.instanceId", "faas.arn", "faas.name"}
+
+// NewAttributeAllowlist builds the set of attributes kept by FilterAttributes. A nil set means there is no allowlist.
+func NewAttributeAllowlist(attributes []string) map[string]bool {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	allowlist := make(map[string]bool, len(attributes)+len(mandatoryAttributes))
+	for _, attribute := range mandatoryAttributes {
+		allowlist[attribute] = true
+	}
+	for _, attribute := range attributes {
+		allowlist[attribute] = true
+	}
+	return allowlist
+}
+
+// FilterAttributes returns only the allowed attributes. A nil allowlist allows every attribute.
+func FilterAttributes(attributes map[string]interface{}, allowlist map[string]bool) map[string]interface{} {
+	if allowlist == nil {
+		return attributes
+	}
+
+	ret := make(map[string]interface{}, len(attributes))
+	for k, v := range attributes {
+		if allowlist[k] {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// LimitAttributes returns at most max attributes, and the number it dropped. Mandatory attributes are kept first,
+// then the others in key order, so that the same attributes are kept every time.
+func LimitAttributes(attributes map[string]interface{}, max int) (map[string]interface{}, int) {
+	if len(attributes) <= max {
+		return attributes, 0
+	}
+
+	ret := make(map[string]interface{}, max)
+	for _, k := range mandatoryAttributes {
+		if v, ok := attributes[k]; ok {
+			ret[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		if _, ok := ret[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(ret) >= max {
+			break
+		}
+		ret[k] = attributes[k]
+	}
+	return ret, len(attributes) - len(ret)
+}
+
+// AccountIDFromARN returns the AWS account ID from an ARN such as arn:aws:lambda:us-east-1:123456789012:function:name,
+// or the empty string if the ARN has no account ID.
+func AccountIDFromARN(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[4]
+}
+
+// UnqualifiedARN returns a Lambda function ARN without its version or alias qualifier, such as
+// arn:aws:lambda:us-east-1:123456789012:function:name for arn:aws:lambda:us-east-1:123456789012:function:name:live.
+// Any other ARN is returned unchanged.
+func UnqualifiedARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) != 8 || parts[0] != "arn" || parts[5] != "function" {
+		return arn
+	}
+	return strings.Join(parts[:7], ":")
+}
+
+// ChunkFunctionLogs splits messages into chunks of at most maxPerChunk messages. A maxPerChunk of zero means no limit.
+// There is always at least one chunk.
+func ChunkFunctionLogs(messages []FunctionLogMessage, maxPerChunk int) [][]FunctionLogMessage {
+	if maxPerChunk <= 0 || len(messages) <= maxPerChunk {
+		return [][]FunctionLogMessage{messages}
+	}
+
+	ret := make([][]FunctionLogMessage, 0, (len(messages)+maxPerChunk-1)/maxPerChunk)
+	for len(messages) > maxPerChunk {
+		ret = append(ret, messages[:maxPerChunk])
+		messages = messages[maxPerChunk:]
+	}
+	return append(ret, messages)
+}
+
+// SanitizeControlChars removes non-printable control characters, other than newlines and tabs, from a log message
+func SanitizeControlChars(message string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, message)
+}
+
+// CollapseDuplicates replaces each run of consecutive messages with identical content and request ID with the first
+// message of the run. When a run has more than one message, its length is recorded in the repeat.count attribute.
+func CollapseDuplicates(messages []FunctionLogMessage) []FunctionLogMessage {
+	ret := make([]FunctionLogMessage, 0, len(messages))
+	count := 0
+	for i, m := range messages {
+		if i > 0 && m.Message == ret[len(ret)-1].Message && m.Attributes["faas.execution"] == ret[len(ret)-1].Attributes["faas.execution"] {
+			count++
+			ret[len(ret)-1].Attributes["repeat.count"] = count
+			continue
+		}
+		ret = append(ret, m)
+		count = 1
+	}
+	return ret
+}
+
+// FlattenAttributes converts nested attribute maps into top-level attributes with dotted keys, so that
+// {"aws": {"lambda_request_id": "x"}} becomes {"aws.lambda_request_id": "x"}.
+func FlattenAttributes(attributes map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(attributes))
+	flattenInto(ret, "", attributes)
+	return ret
+}
+
+func flattenInto(dest map[string]interface{}, prefix string, attributes map[string]interface{}) {
+	for k, v := range attributes {
+		key := prefix + k
+		switch nested := v.(type) {
+		case map[string]interface{}:
+			flattenInto(dest, key+".", nested)
+		case map[string]string:
+			for nk, nv := range nested {
+				dest[key+"."+nk] = nv
+			}
+		default:
+			dest[key] = v
+		}
+	}
+}
+
 func NewDetailedFunctionLog(common map[string]interface{}, logs []FunctionLogMessage) DetailedFunctionLog {
 	return DetailedFunctionLog{
 		Common: CommonLogAttrs{
@@ -83,13 +286,63 @@ type LogsEvent struct {
 	ID        string `json:"id"`
 	Message   string `json:"message"`
 	Timestamp int64  `json:"timestamp"`
+	// records counts the telemetry within the message, which is credited once it is sent
+	records RecordCounts
+}
+
+// logsPayload is a compressed payload of log events, along with the records they hold
+type logsPayload struct {
+	body    *bytes.Buffer
+	records RecordCounts
 }
 
 func LogsEventForBytes(payload []byte) LogsEvent {
 	return LogsEvent{ID: util.UUID(), Message: string(payload), Timestamp: util.Timestamp()}
 }
 
-func CompressedPayloadsForLogEvents(logsEvents []LogsEvent, functionName string, invokedFunctionARN string) ([]*bytes.Buffer, error) {
+// OversizedEventsError reports agent payloads that were left out, because each is too large for a payload on its own.
+// Unlike plain text, an agent payload can't be truncated, since ingest couldn't decode what remained.
+type OversizedEventsError struct {
+	Events        []LogsEvent
+	MaxPayloadLen int
+}
+
+func (e *OversizedEventsError) Error() string {
+	return fmt.Sprintf("%d agent payloads are too large to fit into a payload of at most %d bytes", len(e.Events), e.MaxPayloadLen)
+}
+
+// joinPayloadErrors combines the errors of the two halves of a split batch, keeping all of the oversized events
+func joinPayloadErrors(left error, right error) error {
+	leftOversized, leftOk := left.(*OversizedEventsError)
+	rightOversized, rightOk := right.(*OversizedEventsError)
+	switch {
+	case leftOk && rightOk:
+		events := append(append([]LogsEvent{}, leftOversized.Events...), rightOversized.Events...)
+		return &OversizedEventsError{Events: events, MaxPayloadLen: leftOversized.MaxPayloadLen}
+	case left != nil && !leftOk:
+		return left
+	case right != nil && !rightOk:
+		return right
+	case left != nil:
+		return left
+	default:
+		return right
+	}
+}
+
+// CompressedPayloadsForLogEvents builds payloads for the log events, splitting them so that no payload is larger than
+// maxPayloadLen bytes. A single plain text event that is too large on its own is truncated; a single agent payload is
+// left out, and returned in an *OversizedEventsError.
+func CompressedPayloadsForLogEvents(logsEvents []LogsEvent, functionName string, invokedFunctionARN string, logStreamName string, encoding PayloadEncoding, maxPayloadLen int) ([]*bytes.Buffer, error) {
+	payloads, err := compressedPayloadsForLogEvents(logsEvents, functionName, invokedFunctionARN, logStreamName, encoding, maxPayloadLen, 0)
+	ret := make([]*bytes.Buffer, 0, len(payloads))
+	for _, p := range payloads {
+		ret = append(ret, p.body)
+	}
+	return ret, err
+}
+
+func compressedPayloadsForLogEvents(logsEvents []LogsEvent, functionName string, invokedFunctionARN string, logStreamName string, encoding PayloadEncoding, maxPayloadLen int, depth int) ([]logsPayload, error) {
 	logGroupName := fmt.Sprintf("/aws/lambda/%s", functionName)
 	logEntry := LogsEntry{
 		LogEvents: logsEvents,
@@ -105,43 +358,60 @@ func CompressedPayloadsForLogEvents(logsEvents []LogsEvent, functionName string,
 		FunctionName:       functionName,
 		InvokedFunctionARN: invokedFunctionARN,
 		LogGroupName:       logGroupName,
-		LogStreamName:      util.Id,
+		LogStreamName:      logStreamName,
 	}
 	data := RequestData{Context: context, Entry: string(entry)}
 
-	compressed, err := CompressedJsonPayload(data)
+	compressed, err := CompressedJsonPayload(data, encoding)
 	if err != nil {
 		return nil, err
 	}
 
-	if compressed.Len() <= maxCompressedPayloadLen {
-		ret := []*bytes.Buffer{compressed}
-		return ret, nil
-	} else {
-		// Payload is too large, split in half, recursively
-		split := len(logsEvents) / 2
-		leftRet, err := CompressedPayloadsForLogEvents(logsEvents[0:split], functionName, invokedFunctionARN)
-		if err != nil {
-			return nil, err
+	if compressed.Len() <= maxPayloadLen {
+		payload := logsPayload{body: compressed}
+		for _, event := range logsEvents {
+			payload.records.add(event.records)
 		}
+		return []logsPayload{payload}, nil
+	}
 
-		rightRet, err := CompressedPayloadsForLogEvents(logsEvents[split:], functionName, invokedFunctionARN)
-		if err != nil {
-			return nil, err
-		}
+	if depth >= maxSplitDepth || len(logsEvents) == 0 || (len(logsEvents) == 1 && logsEvents[0].Message == "") {
+		return nil, fmt.Errorf("unable to fit log events into a payload of at most %d bytes", maxPayloadLen)
+	}
 
-		return append(leftRet, rightRet...), nil
+	if len(logsEvents) == 1 {
+		// A single event can't be split, so truncate it, in proportion to how far over the limit it is. Agent
+		// payloads are opaque, so they can only be left out.
+		event := logsEvents[0]
+		if isAgentPayload([]byte(event.Message)) {
+			util.Logf("Leaving out agent payload %s of %d bytes, which can't fit the payload size limit\n", event.ID, len(event.Message))
+			return nil, &OversizedEventsError{Events: []LogsEvent{event}, MaxPayloadLen: maxPayloadLen}
+		}
+		keep := int(int64(len(event.Message)) * int64(maxPayloadLen) / int64(compressed.Len()) * 9 / 10)
+		util.Logf("Truncating log event %s from %d to %d bytes to fit the payload size limit\n", event.ID, len(event.Message), keep)
+		event.Message = strings.ToValidUTF8(event.Message[:keep], "")
+		return compressedPayloadsForLogEvents([]LogsEvent{event}, functionName, invokedFunctionARN, logStreamName, encoding, maxPayloadLen, depth+1)
 	}
+
+	// Payload is too large, split in half, recursively. If one half fails, the other half is still returned,
+	// along with the error.
+	split := len(logsEvents) / 2
+	leftRet, leftErr := compressedPayloadsForLogEvents(logsEvents[0:split], functionName, invokedFunctionARN, logStreamName, encoding, maxPayloadLen, depth+1)
+	rightRet, rightErr := compressedPayloadsForLogEvents(logsEvents[split:], functionName, invokedFunctionARN, logStreamName, encoding, maxPayloadLen, depth+1)
+
+	return append(leftRet, rightRet...), joinPayloadErrors(leftErr, rightErr)
 }
 
-// BuildVortexRequest builds a Vortex HTTP request
-func BuildVortexRequest(ctx context.Context, url string, compressed *bytes.Buffer, userAgent string, licenseKey string) (*http.Request, error) {
+// BuildVortexRequest builds a Vortex HTTP request. The body must have been encoded with the given content encoding.
+func BuildVortexRequest(ctx context.Context, url string, compressed *bytes.Buffer, contentEncoding string, userAgent string, licenseKey string) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(ctx, "POST", url, compressed)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %v", err)
 	}
 
-	req.Header.Add("Content-Encoding", "gzip")
+	if contentEncoding != config.CompressionIdentity {
+		req.Header.Add("Content-Encoding", contentEncoding)
+	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("User-Agent", userAgent)
 	req.Header.Add("X-License-Key", licenseKey)
@@ -149,13 +419,13 @@ func BuildVortexRequest(ctx context.Context, url string, compressed *bytes.Buffe
 	return req, nil
 }
 
-func CompressedJsonPayload(payload interface{}) (*bytes.Buffer, error) {
+func CompressedJsonPayload(payload interface{}, encoding PayloadEncoding) (*bytes.Buffer, error) {
 	uncompressed, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	compressed, err := util.Compress(uncompressed)
+	compressed, err := encoding.encode(uncompressed)
 	if err != nil {
 		return nil, fmt.Errorf("error compressing data: %v", err)
 	}
@@ -1,9 +1,18 @@
 package telemetry
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/util"
 )
 
 func TestSerialize_DetailedFunctionLog(t *testing.T) {
@@ -20,3 +29,279 @@ func TestSerialize_DetailedFunctionLog(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "{\"common\":{\"attributes\":{\"foo\":\"bar\"}},\"logs\":[{\"message\":\"message1\",\"timestamp\":1234,\"attributes\":{\"aws\":{\"lambda_request_id\":\"test1\"},\"faas.execution\":\"test1\",\"trace.id\":\"123456789\"}},{\"message\":\"message2\",\"timestamp\":1235,\"attributes\":{\"aws\":{\"lambda_request_id\":\"test2\"},\"faas.execution\":\"test2\",\"trace.id\":\"123456789\"}}]}", string(json_bytes))
 }
+
+func BenchmarkLogsEventForBytes(b *testing.B) {
+	payload := []byte("foobar")
+	for i := 0; i < b.N; i++ {
+		LogsEventForBytes(payload)
+	}
+}
+
+func TestFlattenAttributes(t *testing.T) {
+	message := NewFunctionLogMessage(1234, "test1", "123456789", "message1")
+
+	nested, err := json.Marshal(message.Attributes)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"aws\":{\"lambda_request_id\":\"test1\"},\"faas.execution\":\"test1\",\"trace.id\":\"123456789\"}", string(nested))
+
+	flattened, err := json.Marshal(FlattenAttributes(message.Attributes))
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"aws.lambda_request_id\":\"test1\",\"faas.execution\":\"test1\",\"trace.id\":\"123456789\"}", string(flattened))
+
+	deep := FlattenAttributes(map[string]interface{}{
+		"entity": map[string]interface{}{
+			"name": "foo",
+			"guid": map[string]interface{}{"value": "bar"},
+		},
+		"count": 3,
+	})
+	assert.Equal(t, map[string]interface{}{"entity.name": "foo", "entity.guid.value": "bar", "count": 3}, deep)
+}
+
+func TestCollapseDuplicates(t *testing.T) {
+	messages := []FunctionLogMessage{
+		NewFunctionLogMessage(1, "test1", "", "retrying"),
+		NewFunctionLogMessage(2, "test1", "", "retrying"),
+		NewFunctionLogMessage(3, "test1", "", "retrying"),
+		NewFunctionLogMessage(4, "test1", "", "done"),
+		NewFunctionLogMessage(5, "test2", "", "done"),
+		NewFunctionLogMessage(6, "test2", "", "retrying"),
+	}
+
+	collapsed := CollapseDuplicates(messages)
+	assert.Equal(t, 4, len(collapsed))
+
+	assert.Equal(t, "retrying", collapsed[0].Message)
+	assert.Equal(t, int64(1), collapsed[0].Timestamp)
+	assert.Equal(t, 3, collapsed[0].Attributes["repeat.count"])
+
+	// Same content, but different invocations
+	assert.Equal(t, "test1", collapsed[1].Attributes["faas.execution"])
+	assert.Equal(t, "test2", collapsed[2].Attributes["faas.execution"])
+
+	for _, m := range collapsed[1:] {
+		assert.NotContains(t, m.Attributes, "repeat.count")
+	}
+
+	assert.Empty(t, CollapseDuplicates(nil))
+}
+
+func TestSanitizeControlChars(t *testing.T) {
+	assert.Equal(t, "line one\n\tline [0mtwo", SanitizeControlChars("line\x00 one\r\n\tline \x1b[0mtwo\x7f"))
+	assert.Equal(t, "plain message", SanitizeControlChars("plain message"))
+	assert.Equal(t, "héllo ✓", SanitizeControlChars("héllo\x07 ✓"))
+}
+
+func TestAccountIDFromARN(t *testing.T) {
+	assert.Equal(t, "123456789012", AccountIDFromARN("arn:aws:lambda:us-east-1:123456789012:function:my-function"))
+	assert.Equal(t, "123456789012", AccountIDFromARN("arn:aws:lambda:us-east-1:123456789012:function:my-function:7"))
+	assert.Equal(t, "", AccountIDFromARN(""))
+	assert.Equal(t, "", AccountIDFromARN("my-function"))
+	assert.Equal(t, "", AccountIDFromARN("arn:aws:lambda:us-east-1"))
+}
+
+func TestUnqualifiedARN(t *testing.T) {
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:my-function", UnqualifiedARN("arn:aws:lambda:us-east-1:123456789012:function:my-function:7"))
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:my-function", UnqualifiedARN("arn:aws:lambda:us-east-1:123456789012:function:my-function:live"))
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:my-function", UnqualifiedARN("arn:aws:lambda:us-east-1:123456789012:function:my-function"))
+	assert.Equal(t, "", UnqualifiedARN(""))
+	assert.Equal(t, "my-function", UnqualifiedARN("my-function"))
+}
+
+func TestCompressedPayloadsForLogEventsPartialFailure(t *testing.T) {
+	defer func() {
+		compress = util.CompressLevel
+	}()
+	compress = func(b []byte, level int) (*bytes.Buffer, error) {
+		// Only the half holding just the bad event fails
+		if bytes.Contains(b, []byte("bad-event")) && !bytes.Contains(b, []byte("good-event")) {
+			return nil, fmt.Errorf("compression failed")
+		}
+		return util.CompressLevel(b, level)
+	}
+
+	// Random data is incompressible, so the two events together are too large for one payload
+	randomMessage := func() string {
+		raw := make([]byte, 600*1024)
+		_, err := rand.Read(raw)
+		assert.NoError(t, err)
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	logsEvents := []LogsEvent{
+		{ID: "good-event", Message: randomMessage(), Timestamp: 1},
+		{ID: "bad-event", Message: randomMessage(), Timestamp: 2},
+	}
+
+	payloads, err := CompressedPayloadsForLogEvents(logsEvents, "function", "arn", util.Id, DefaultPayloadEncoding, maxCompressedPayloadLen)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(payloads))
+
+	uncompressed, err := util.Uncompress(payloads[0].Bytes())
+	assert.NoError(t, err)
+	assert.Contains(t, string(uncompressed), "good-event")
+	assert.NotContains(t, string(uncompressed), "bad-event")
+}
+
+func TestBuildVortexRequestContentEncoding(t *testing.T) {
+	req, err := BuildVortexRequest(context.Background(), "https://example.com", &bytes.Buffer{}, config.CompressionGzip, "agent", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+
+	req, err = BuildVortexRequest(context.Background(), "https://example.com", &bytes.Buffer{}, config.CompressionIdentity, "agent", "key")
+	assert.NoError(t, err)
+	assert.Empty(t, req.Header.Values("Content-Encoding"))
+}
+
+func TestCompressedPayloadsForLogEventsMaxPayloadLen(t *testing.T) {
+	// Identity encoding makes payload sizes predictable
+	identity := PayloadEncoding{ContentEncoding: config.CompressionIdentity}
+	logsEvents := []LogsEvent{
+		{ID: "1", Message: "first", Timestamp: 1},
+		{ID: "2", Message: "second", Timestamp: 2},
+	}
+
+	whole, err := CompressedPayloadsForLogEvents(logsEvents, "function", "arn", util.Id, identity, maxCompressedPayloadLen)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(whole))
+	wholeLen := whole[0].Len()
+
+	payloads, err := CompressedPayloadsForLogEvents(logsEvents, "function", "arn", util.Id, identity, wholeLen)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(payloads))
+
+	payloads, err = CompressedPayloadsForLogEvents(logsEvents, "function", "arn", util.Id, identity, wholeLen-1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(payloads))
+	for _, p := range payloads {
+		assert.True(t, p.Len() <= wholeLen-1)
+	}
+}
+
+func TestCompressedPayloadsForLogEventsOversizedEvent(t *testing.T) {
+	// Random data is incompressible, so this single plain text event is far larger than the limit
+	raw := make([]byte, 2*maxCompressedPayloadLen)
+	_, err := rand.Read(raw)
+	assert.NoError(t, err)
+	message := "REPORT RequestId: abc " + base64.StdEncoding.EncodeToString(raw)
+	logsEvents := []LogsEvent{{ID: "huge-event", Message: message, Timestamp: 1}}
+
+	payloads, err := CompressedPayloadsForLogEvents(logsEvents, "function", "arn", util.Id, DefaultPayloadEncoding, maxCompressedPayloadLen)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(payloads))
+	assert.True(t, payloads[0].Len() <= maxCompressedPayloadLen)
+
+	uncompressed, err := util.Uncompress(payloads[0].Bytes())
+	assert.NoError(t, err)
+	var data RequestData
+	assert.NoError(t, json.Unmarshal(uncompressed, &data))
+	var entry LogsEntry
+	assert.NoError(t, json.Unmarshal([]byte(data.Entry), &entry))
+	assert.Equal(t, 1, len(entry.LogEvents))
+	assert.True(t, len(entry.LogEvents[0].Message) < len(message))
+	assert.True(t, strings.HasPrefix(message, entry.LogEvents[0].Message))
+
+	// Not even the payload envelope fits; this fails rather than recursing forever
+	payloads, err = CompressedPayloadsForLogEvents(logsEvents, "function", "arn", util.Id, DefaultPayloadEncoding, 10)
+	assert.Error(t, err)
+	assert.Empty(t, payloads)
+}
+
+func TestCompressedPayloadsForLogEventsOversizedAgentPayload(t *testing.T) {
+	raw := make([]byte, 2*maxCompressedPayloadLen)
+	_, err := rand.Read(raw)
+	assert.NoError(t, err)
+	agentPayload, err := encodePayload(map[string]interface{}{
+		"metadata": map[string]interface{}{},
+		"data":     map[string]interface{}{"padding": base64.StdEncoding.EncodeToString(raw)},
+	})
+	assert.NoError(t, err)
+
+	logsEvents := []LogsEvent{
+		{ID: "small-event", Message: "REPORT RequestId: abc", Timestamp: 1},
+		{ID: "huge-event", Message: string(agentPayload), Timestamp: 2},
+	}
+
+	// The agent payload can't be truncated, so it is left out, and handed back to the caller
+	payloads, err := CompressedPayloadsForLogEvents(logsEvents, "function", "arn", util.Id, DefaultPayloadEncoding, maxCompressedPayloadLen)
+	assert.Equal(t, 1, len(payloads))
+	oversized, ok := err.(*OversizedEventsError)
+	if assert.True(t, ok, err) {
+		assert.Equal(t, []LogsEvent{logsEvents[1]}, oversized.Events)
+	}
+
+	// What is sent can still be decoded by ingest
+	uncompressed, err := util.Uncompress(payloads[0].Bytes())
+	assert.NoError(t, err)
+	var data RequestData
+	assert.NoError(t, json.Unmarshal(uncompressed, &data))
+	var entry LogsEntry
+	assert.NoError(t, json.Unmarshal([]byte(data.Entry), &entry))
+	if assert.Equal(t, 1, len(entry.LogEvents)) {
+		assert.Equal(t, "small-event", entry.LogEvents[0].ID)
+	}
+}
+
+func TestJoinPayloadErrors(t *testing.T) {
+	left := &OversizedEventsError{Events: []LogsEvent{{ID: "1"}}, MaxPayloadLen: 10}
+	right := &OversizedEventsError{Events: []LogsEvent{{ID: "2"}}, MaxPayloadLen: 10}
+	other := fmt.Errorf("other")
+
+	assert.Nil(t, joinPayloadErrors(nil, nil))
+	assert.Equal(t, left, joinPayloadErrors(left, nil))
+	assert.Equal(t, right, joinPayloadErrors(nil, right))
+	assert.Equal(t, other, joinPayloadErrors(left, other))
+	assert.Equal(t, &OversizedEventsError{Events: []LogsEvent{{ID: "1"}, {ID: "2"}}, MaxPayloadLen: 10}, joinPayloadErrors(left, right))
+}
+
+func TestFilterAttributes(t *testing.T) {
+	attributes := map[string]interface{}{
+		"plugin":         util.Id,
+		"faas.arn":       "arn",
+		"faas.name":      "name",
+		"faas.execution": "test1",
+		"trace.id":       "123456789",
+		"aws":            map[string]string{"lambda_request_id": "test1"},
+	}
+
+	assert.Equal(t, attributes, FilterAttributes(attributes, NewAttributeAllowlist(nil)))
+
+	filtered := FilterAttributes(attributes, NewAttributeAllowlist([]string{"trace.id", "not.present"}))
+	assert.Equal(t, map[string]interface{}{
+		"plugin":    util.Id,
+		"faas.arn":  "arn",
+		"faas.name": "name",
+		"trace.id":  "123456789",
+	}, filtered)
+}
+
+func TestPayloadContentEncoding(t *testing.T) {
+	compressed, err := util.Compress([]byte("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, config.CompressionGzip, payloadContentEncoding(compressed.Bytes()))
+	assert.Equal(t, config.CompressionIdentity, payloadContentEncoding([]byte("{}")))
+	assert.Equal(t, config.CompressionIdentity, payloadContentEncoding(nil))
+}
+
+func TestLimitAttributes(t *testing.T) {
+	attributes := map[string]interface{}{
+		"plugin":    util.Id,
+		"faas.arn":  "arn",
+		"faas.name": "name",
+		"d":         4,
+		"b":         2,
+		"a":         1,
+		"c":         3,
+	}
+
+	limited, dropped := LimitAttributes(attributes, len(attributes))
+	assert.Equal(t, attributes, limited)
+	assert.Equal(t, 0, dropped)
+
+	limited, dropped = LimitAttributes(attributes, 5)
+	assert.Equal(t, map[string]interface{}{"plugin": util.Id, "faas.arn": "arn", "faas.name": "name", "a": 1, "b": 2}, limited)
+	assert.Equal(t, 2, dropped)
+
+	limited, dropped = LimitAttributes(attributes, 1)
+	assert.Equal(t, map[string]interface{}{"plugin": util.Id, "faas.arn": "arn", "faas.name": "name"}, limited)
+	assert.Equal(t, 4, dropped)
+}
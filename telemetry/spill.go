@@ -0,0 +1,116 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/newrelic/newrelic-lambda-extension/util"
+)
+
+const (
+	// maxSpillBytes caps the total size of the spill directory. Spilling is best-effort; once full, failed payloads
+	// are dropped as they would be without a spill directory.
+	maxSpillBytes = 5 * 1024 * 1024
+
+	spillFileSuffix = ".payload"
+)
+
+// spill writes a payload that could not be delivered to the spill directory, if one is configured, so that it can be
+// resent by a later sandbox.
+func (c *Client) spill(endpointName string, payload []byte) {
+	if c.spillDir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(c.spillDir, 0700); err != nil {
+		util.Logf("Unable to create spill directory %s: %v", c.spillDir, err)
+		return
+	}
+
+	if dirSize(c.spillDir, spillFileSuffix)+int64(len(payload)) > maxSpillBytes {
+		util.Logf("Spill directory %s is full, dropping %d byte %s payload", c.spillDir, len(payload), endpointName)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%d-%s%s", endpointName, time.Now().UnixNano(), util.UUID(), spillFileSuffix)
+	if err := ioutil.WriteFile(filepath.Join(c.spillDir, name), payload, 0600); err != nil {
+		util.Logf("Unable to spill %s payload: %v", endpointName, err)
+		return
+	}
+
+	util.Debugf("Spilled %d byte %s payload to %s", len(payload), endpointName, name)
+}
+
+// SendSpilled resends payloads spilled by a previous sandbox, and returns the number sent successfully. Each spill
+// file is removed before it is sent; a payload that fails again is spilled anew.
+func (c *Client) SendSpilled(ctx context.Context) int {
+	if c.spillDir == "" {
+		return 0
+	}
+
+	files, err := ioutil.ReadDir(c.spillDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			util.Logf("Unable to read spill directory %s: %v", c.spillDir, err)
+		}
+		return 0
+	}
+
+	sent := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spillFileSuffix) {
+			continue
+		}
+
+		path := filepath.Join(c.spillDir, f.Name())
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			util.Logf("Unable to read spilled payload %s: %v", f.Name(), err)
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			util.Logf("Unable to remove spilled payload %s: %v", f.Name(), err)
+			continue
+		}
+
+		endpointName := strings.SplitN(f.Name(), "-", 2)[0]
+		builder := c.requestBuilderFor(ctx, endpointName)
+		if builder == nil {
+			util.Logf("Discarding spilled payload %s for unknown endpoint", f.Name())
+			continue
+		}
+
+		successCount, _, _ := c.sendPayloads(endpointName, []*bytes.Buffer{bytes.NewBuffer(payload)}, builder)
+		sent += successCount
+	}
+
+	if sent > 0 {
+		util.Logf("Resent %d spilled payloads", sent)
+	}
+
+	return sent
+}
+
+// dirSize returns the total size of the files in dir with the given suffix
+func dirSize(dir string, suffix string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), suffix) {
+			size += f.Size()
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,144 @@
+package telemetry
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/lambda/logserver"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpillOnFailure(t *testing.T) {
+	spillDir, err := ioutil.TempDir("", "spill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, SpillDir: spillDir}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	ctx := context.Background()
+	err, successCount := client.SendTelemetry(ctx, "arn:aws:lambda:us-east-1:1234:function:newrelic-example-go", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+
+	err = client.SendFunctionLogs(ctx, "arn:aws:lambda:us-east-1:1234:function:newrelic-example-go", []logserver.LogLine{{Time: time.Now(), RequestID: "abc", Content: []byte("log")}})
+	assert.NoError(t, err)
+
+	files, err := ioutil.ReadDir(spillDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	joined := strings.Join(names, " ")
+	assert.Contains(t, joined, TelemetryEndpointName+"-")
+	assert.Contains(t, joined, LogEndpointName+"-")
+}
+
+func TestSpillSkippedForClientErrors(t *testing.T) {
+	spillDir, err := ioutil.TempDir("", "spill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(403)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, SpillDir: spillDir}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	err, _ = client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+
+	files, err := ioutil.ReadDir(spillDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSendSpilled(t *testing.T) {
+	spillDir, err := ioutil.TempDir("", "spill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	compressed, err := util.Compress([]byte("[]"))
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(spillDir, LogEndpointName+"-1-abc"+spillFileSuffix), compressed.Bytes(), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(spillDir, "unknown-1-abc"+spillFileSuffix), compressed.Bytes(), 0600))
+
+	var logRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		if r.Header.Get("X-Event-Source") == "logs" {
+			atomic.AddInt32(&logRequests, 1)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, compressed.Bytes(), body)
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, SpillDir: spillDir}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	assert.Equal(t, 1, client.SendSpilled(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logRequests))
+
+	files, err := ioutil.ReadDir(spillDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSendSpilledNoDir(t *testing.T) {
+	client := NewWithHTTPClient(&http.Client{}, &config.Configuration{SpillDir: "/this/path/should/not/exist"}, "", "a mock license key", &Batch{})
+	assert.Equal(t, 0, client.SendSpilled(context.Background()))
+}
+
+func TestSpillSkippedForRequestBuildErrors(t *testing.T) {
+	spillDir, err := ioutil.TempDir("", "spill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spillDir)
+
+	deadLetterDir, err := ioutil.TempDir("", "dead-letter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(deadLetterDir)
+
+	// The space makes the URL invalid, so no request can be built for it
+	conf := &config.Configuration{TelemetryEndpoint: "http://invalid host", SpillDir: spillDir, DeadLetterDir: deadLetterDir}
+	client := NewWithHTTPClient(&http.Client{}, conf, "", "a mock license key", &Batch{})
+
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+
+	spilled, err := ioutil.ReadDir(spillDir)
+	assert.NoError(t, err)
+	assert.Empty(t, spilled)
+
+	deadLettered, err := ioutil.ReadDir(deadLetterDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(deadLettered))
+}
@@ -0,0 +1,81 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/newrelic/newrelic-lambda-extension/util"
+)
+
+const shutdownEventType = "LambdaExtensionShutdown"
+
+// ShutdownSummary totals what the client sent over the life of the sandbox. It is sent as a LambdaExtensionShutdown
+// custom event, once everything else has been flushed.
+type ShutdownSummary struct {
+	RecordCounts
+	BytesSent    int
+	Errors       int
+	UptimeMillis int64
+}
+
+// ShutdownSummary totals the send counters of all endpoints, for a sandbox that has been up for the given time
+func (c *Client) ShutdownSummary(uptime time.Duration) ShutdownSummary {
+	stats := c.Stats()
+
+	ret := ShutdownSummary{RecordCounts: stats.Records, UptimeMillis: uptime.Milliseconds()}
+	for _, s := range stats.Endpoints {
+		ret.BytesSent += s.BytesSent
+		ret.Errors += s.Failures
+	}
+	return ret
+}
+
+// attributes are the custom attributes of the summary event
+func (s ShutdownSummary) attributes() map[string]interface{} {
+	return map[string]interface{}{
+		"plugin":               util.Id,
+		"extension.instanceId": util.InstanceId,
+		"eventsSent":           s.Events,
+		"metricsSent":          s.Metrics,
+		"tracesSent":           s.Traces,
+		"logsSent":             s.Logs,
+		"bytesSent":            s.BytesSent,
+		"errors":               s.Errors,
+		"uptimeMillis":         s.UptimeMillis,
+	}
+}
+
+// SendShutdownSummary sends the shutdown summary to the telemetry endpoint, as a custom event within an agent payload.
+// It should be the last thing sent, so that the summary covers everything else.
+func (c *Client) SendShutdownSummary(ctx context.Context, invokedFunctionARN string, uptime time.Duration) error {
+	return c.sendCustomEvent(ctx, invokedFunctionARN, shutdownEventType, c.ShutdownSummary(uptime).attributes())
+}
+
+// sendCustomEvent sends a single custom event to the telemetry endpoint, wrapped in an agent payload
+func (c *Client) sendCustomEvent(ctx context.Context, invokedFunctionARN string, eventType string, attributes map[string]interface{}) error {
+	event := []interface{}{
+		map[string]interface{}{"type": eventType, "timestamp": util.Timestamp()},
+		attributes,
+		map[string]interface{}{},
+	}
+
+	payload, err := encodePayload(map[string]interface{}{
+		"metadata": map[string]interface{}{"arn": invokedFunctionARN, "agent_version": util.Version},
+		"data": map[string]interface{}{
+			"custom_event_data": []interface{}{nil, map[string]interface{}{"reservoir_size": 1, "events_seen": 1}, []interface{}{event}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding %s event: %v", eventType, err)
+	}
+
+	err, successCount := c.SendTelemetry(ctx, invokedFunctionARN, [][]byte{payload})
+	if err != nil {
+		return err
+	}
+	if successCount == 0 {
+		return fmt.Errorf("the %s event was not accepted", eventType)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/lambda/logserver"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// agentPayload builds an agent payload holding the given numbers of events, metrics and span events
+func agentPayload(t *testing.T, events, metrics, spans int) []byte {
+	items := func(n int) []interface{} {
+		ret := make([]interface{}, n)
+		for i := range ret {
+			ret[i] = []interface{}{map[string]interface{}{}, map[string]interface{}{}, map[string]interface{}{}}
+		}
+		return ret
+	}
+
+	payload, err := encodePayload(map[string]interface{}{
+		"metadata": map[string]interface{}{},
+		"data": map[string]interface{}{
+			"analytic_event_data": []interface{}{nil, map[string]interface{}{}, items(events)},
+			"metric_data":         []interface{}{nil, 0, 0, items(metrics)},
+			"span_event_data":     []interface{}{nil, map[string]interface{}{}, items(spans)},
+		},
+	})
+	assert.NoError(t, err)
+	return payload
+}
+
+// batchedInvocation returns an invocation holding the given telemetry, added through a batch so that it is counted
+func batchedInvocation(requestId string, telemetry ...[]byte) *Invocation {
+	batch := NewBatch(&config.Configuration{})
+	batch.AddInvocation(requestId, time.Now())
+	for _, payload := range telemetry {
+		batch.AddTelemetry(requestId, payload)
+	}
+	return batch.invocations[requestId]
+}
+
+func TestClientShutdownSummary(t *testing.T) {
+	var failing int32
+	var lastTelemetry string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+
+		if r.Header.Get("X-Event-Source") != "logs" {
+			reqBytes, err := ioutil.ReadAll(r.Body)
+			assert.NoError(t, err)
+			reqBody, err := util.Uncompress(reqBytes)
+			assert.NoError(t, err)
+
+			var reqData RequestData
+			assert.NoError(t, json.Unmarshal(reqBody, &reqData))
+			var logsEntry LogsEntry
+			assert.NoError(t, json.Unmarshal([]byte(reqData.Entry), &logsEntry))
+			lastTelemetry = logsEntry.LogEvents[0].Message
+		}
+
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, MaxAttempts: 1}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	assert.Equal(t, ShutdownSummary{}, client.ShutdownSummary(0))
+
+	ctx := context.Background()
+	err, successCount := client.SendInvocations(ctx, "", []*Invocation{batchedInvocation("abc", agentPayload(t, 2, 3, 4), []byte("REPORT RequestId: abc"))})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+
+	lines := []logserver.LogLine{
+		{Time: time.Now(), RequestID: "abc", Content: []byte("first")},
+		{Time: time.Now(), RequestID: "abc", Content: []byte("second")},
+	}
+	assert.NoError(t, client.SendFunctionLogs(ctx, "", lines))
+
+	// Records that aren't sent aren't counted, and neither are those sent other than from the batch
+	atomic.StoreInt32(&failing, 1)
+	err, successCount = client.SendInvocations(ctx, "", []*Invocation{batchedInvocation("def", agentPayload(t, 1, 1, 1))})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, successCount)
+	atomic.StoreInt32(&failing, 0)
+	err, successCount = client.SendTelemetry(ctx, "", [][]byte{agentPayload(t, 1, 1, 1)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+
+	stats := client.Stats()
+	summary := client.ShutdownSummary(1500 * time.Millisecond)
+	assert.Equal(t, RecordCounts{Events: 2, Metrics: 3, Traces: 4, Logs: 2}, summary.RecordCounts)
+	assert.Equal(t, stats.Endpoints[TelemetryEndpointName].BytesSent+stats.Endpoints[LogEndpointName].BytesSent, summary.BytesSent)
+	assert.Equal(t, 1, summary.Errors)
+	assert.Equal(t, int64(1500), summary.UptimeMillis)
+
+	assert.NoError(t, client.SendShutdownSummary(ctx, "arn:aws:lambda:us-east-1:123456789012:function:my-function", 1500*time.Millisecond))
+
+	decoded, err := base64.StdEncoding.DecodeString(lastTelemetry)
+	assert.NoError(t, err)
+	segments, err := parsePayload(decoded)
+	assert.NoError(t, err)
+
+	var customEvents []json.RawMessage
+	assert.NoError(t, json.Unmarshal(segments["data"]["custom_event_data"], &customEvents))
+	var events [][]map[string]interface{}
+	assert.NoError(t, json.Unmarshal(customEvents[2], &events))
+	assert.Len(t, events, 1)
+
+	assert.Equal(t, shutdownEventType, events[0][0]["type"])
+	attributes := events[0][1]
+	assert.Equal(t, float64(2), attributes["eventsSent"])
+	assert.Equal(t, float64(3), attributes["metricsSent"])
+	assert.Equal(t, float64(4), attributes["tracesSent"])
+	assert.Equal(t, float64(2), attributes["logsSent"])
+	assert.Equal(t, float64(summary.BytesSent), attributes["bytesSent"])
+	assert.Equal(t, float64(1), attributes["errors"])
+	assert.Equal(t, float64(1500), attributes["uptimeMillis"])
+}
+
+func TestClientRecordsCreditedPerPayload(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+
+		// Reject the second half of the split batch
+		if atomic.AddInt32(&requests, 1) == 2 {
+			w.WriteHeader(400)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: srv.URL, LogEndpoint: srv.URL, MaxAttempts: 1}
+	client := NewWithHTTPClient(srv.Client(), conf, "", "a mock license key", &Batch{})
+
+	invocations := []*Invocation{
+		batchedInvocation("abc", agentPayload(t, 2, 3, 4)),
+		batchedInvocation("def", agentPayload(t, 5, 6, 7)),
+	}
+
+	// Only fit one invocation's telemetry in each payload. Agent payloads are incompressible, so two never fit.
+	client.maxPayloadLen = 0
+	for _, inv := range invocations {
+		single, err := CompressedPayloadsForLogEvents([]LogsEvent{LogsEventForBytes(inv.Telemetry[0])}, "", "", client.logStreamName, client.payloadEncoding, maxCompressedPayloadLen)
+		assert.NoError(t, err)
+		if single[0].Len()+16 > client.maxPayloadLen {
+			client.maxPayloadLen = single[0].Len() + 16
+		}
+	}
+
+	err, successCount := client.SendInvocations(context.Background(), "", invocations)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	assert.Equal(t, RecordCounts{Events: 2, Metrics: 3, Traces: 4}, client.Stats().Records)
+}
@@ -0,0 +1,71 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+)
+
+// webhookTimeout bounds each webhook request. It is kept short, since forwards can hold up shutdown.
+const webhookTimeout = time.Second
+
+// newWebhookClient returns an HTTP client for the webhook. It has its own connections and timeout, so that a slow
+// webhook can't hold up sends to New Relic.
+func newWebhookClient(conf *config.Configuration) *http.Client {
+	if conf.WebhookURL == "" {
+		return nil
+	}
+
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: newTransport(conf),
+	}
+}
+
+// forwardToWebhook POSTs copies of the payloads to the configured webhook, in the background. Sends to New Relic never
+// wait for it; WaitForWebhooks does. Webhook failures are logged, and never affect sends to New Relic.
+func (c *Client) forwardToWebhook(ctx context.Context, endpointName string, payloads []*bytes.Buffer) {
+	if c.webhookURL == "" {
+		return
+	}
+
+	for _, p := range payloads {
+		c.webhookTasks.Add(1)
+		go func(payload []byte) {
+			defer c.webhookTasks.Done()
+
+			req, err := http.NewRequestWithContext(ctx, "POST", c.webhookURL, bytes.NewReader(payload))
+			if err != nil {
+				util.Logf("Error creating webhook request: %v", err)
+				return
+			}
+
+			if contentEncoding := payloadContentEncoding(payload); contentEncoding != config.CompressionIdentity {
+				req.Header.Add("Content-Encoding", contentEncoding)
+			}
+			req.Header.Add("Content-Type", "application/json")
+			req.Header.Add("User-Agent", util.Name)
+			req.Header.Add("X-Event-Source", endpointName)
+
+			res, err := c.webhookClient.Do(req)
+			if err != nil {
+				util.Logf("Webhook error: %v", err)
+				return
+			}
+			defer util.Close(res.Body)
+
+			if res.StatusCode >= 300 {
+				util.Logf("Webhook response: [%s]", res.Status)
+			}
+		}(p.Bytes())
+	}
+}
+
+// WaitForWebhooks waits for every webhook forward so far to finish. It is called at shutdown.
+func (c *Client) WaitForWebhooks() {
+	c.webhookTasks.Wait()
+}
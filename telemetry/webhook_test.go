@@ -0,0 +1,113 @@
+package telemetry
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-lambda-extension/config"
+	"github.com/newrelic/newrelic-lambda-extension/lambda/logserver"
+	"github.com/newrelic/newrelic-lambda-extension/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookForwarding(t *testing.T) {
+	var nrRequests, webhookRequests int32
+
+	nrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		atomic.AddInt32(&nrRequests, 1)
+		w.WriteHeader(200)
+	}))
+	defer nrSrv.Close()
+
+	webhookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		atomic.AddInt32(&webhookRequests, 1)
+
+		assert.Empty(t, r.Header.Get("X-License-Key"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+
+		reqBytes, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		_, err = util.Uncompress(reqBytes)
+		assert.NoError(t, err)
+
+		w.WriteHeader(200)
+	}))
+	defer webhookSrv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: nrSrv.URL, LogEndpoint: nrSrv.URL, WebhookURL: webhookSrv.URL}
+	client := NewWithHTTPClient(&http.Client{}, conf, "", "a mock license key", &Batch{})
+
+	ctx := context.Background()
+	err, successCount := client.SendTelemetry(ctx, "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+
+	err = client.SendFunctionLogs(ctx, "", []logserver.LogLine{{Time: time.Now(), RequestID: "abc", Content: []byte("log")}})
+	assert.NoError(t, err)
+
+	client.WaitForWebhooks()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&nrRequests))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&webhookRequests))
+}
+
+func TestWebhookFailureDoesNotAffectSend(t *testing.T) {
+	nrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(200)
+	}))
+	defer nrSrv.Close()
+
+	webhookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(500)
+	}))
+	defer webhookSrv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: nrSrv.URL, LogEndpoint: nrSrv.URL, WebhookURL: webhookSrv.URL}
+	client := NewWithHTTPClient(&http.Client{}, conf, "", "a mock license key", &Batch{})
+
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+	assert.Equal(t, 1, client.Stats().Endpoints[TelemetryEndpointName].Successes)
+}
+
+func TestWebhookDoesNotHoldUpSend(t *testing.T) {
+	nrSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		w.WriteHeader(200)
+	}))
+	defer nrSrv.Close()
+
+	release := make(chan struct{})
+	var webhookRequests int32
+	webhookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer util.Close(r.Body)
+		<-release
+		atomic.AddInt32(&webhookRequests, 1)
+		w.WriteHeader(200)
+	}))
+	defer webhookSrv.Close()
+
+	conf := &config.Configuration{TelemetryEndpoint: nrSrv.URL, LogEndpoint: nrSrv.URL, WebhookURL: webhookSrv.URL}
+	client := NewWithHTTPClient(&http.Client{}, conf, "", "a mock license key", &Batch{})
+	assert.NotSame(t, client.httpClient, client.webhookClient)
+	assert.Equal(t, webhookTimeout, client.webhookClient.Timeout)
+
+	// The send completes while the webhook is still stuck
+	err, successCount := client.SendTelemetry(context.Background(), "", [][]byte{[]byte("foobar")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, successCount)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&webhookRequests))
+
+	close(release)
+	client.WaitForWebhooks()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&webhookRequests))
+}
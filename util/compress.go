@@ -8,10 +8,19 @@ import (
 
 // Compress gzips the given input.
 func Compress(b []byte) (*bytes.Buffer, error) {
+	return CompressLevel(b, gzip.DefaultCompression)
+}
+
+// CompressLevel gzips the given input, at the given compression level.
+func CompressLevel(b []byte, level int) (*bytes.Buffer, error) {
 	var buf bytes.Buffer
 
-	w := gzip.NewWriter(&buf)
-	_, err := w.Write(b)
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(b)
 	if err != nil {
 		return nil, err
 	}
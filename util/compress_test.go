@@ -23,3 +23,15 @@ func TestUncompress(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotEmpty(t, b)
 }
+
+func TestCompressLevel(t *testing.T) {
+	c, err := CompressLevel([]byte("foobar"), 9)
+	assert.Nil(t, err)
+
+	b, err := Uncompress(c.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, "foobar", string(b))
+
+	_, err = CompressLevel([]byte("foobar"), 42)
+	assert.Error(t, err)
+}
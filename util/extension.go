@@ -5,3 +5,6 @@ const (
 	Version = "2.3.3"
 	Id      = Name + ":" + Version
 )
+
+// InstanceId identifies this run of the extension, and so the sandbox it runs in
+var InstanceId = UUID()
@@ -2,6 +2,9 @@ package util
 
 import "log"
 
+// LogPrefix starts every line the extension logs
+const LogPrefix = "[NR_EXT] "
+
 var logger = Logger{
 	isEnabled:      true,
 	isDebugEnabled: false,
@@ -14,7 +17,7 @@ type Logger struct {
 
 func ConfigLogger(logsEnabled bool, isDebugEnabled bool) {
 	// Go Logging config
-	log.SetPrefix("[NR_EXT] ")
+	log.SetPrefix(LogPrefix)
 	log.SetFlags(0)
 
 	log.Println("New Relic Lambda Extension starting up")
@@ -1,9 +1,14 @@
 package util
 
-import (
-	"github.com/google/uuid"
-)
+import "github.com/google/uuid"
 
+func init() {
+	// Read random bytes from crypto/rand in bulk, rather than once per UUID, since we generate one for every log event
+	// we send
+	uuid.EnableRandPool()
+}
+
+// UUID returns a random (version 4) UUID
 func UUID() string {
 	return uuid.New().String()
 }
@@ -3,9 +3,35 @@ package util
 import (
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestUUID(t *testing.T) {
 	assert.NotEmpty(t, UUID())
+
+	parsed, err := uuid.Parse(UUID())
+	assert.NoError(t, err)
+	assert.Equal(t, uuid.Version(4), parsed.Version())
+	assert.Equal(t, uuid.RFC4122, parsed.Variant())
+
+	assert.NotEqual(t, UUID(), UUID())
+}
+
+// BenchmarkUUID compares UUID generation with the random pool, as used, against reading crypto/rand for each UUID
+func BenchmarkUUID(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			UUID()
+		}
+	})
+
+	b.Run("unpooled", func(b *testing.B) {
+		uuid.DisableRandPool()
+		defer uuid.EnableRandPool()
+
+		for i := 0; i < b.N; i++ {
+			UUID()
+		}
+	})
 }